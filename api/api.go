@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Prefix Префикс версионированного API
+const Prefix = "/api/v1"
+
+// Ограничения на размер тела запроса, у пачки выражений оно больше
+const (
+	MaxBodySize      = 1 << 20
+	MaxBatchBodySize = 8 << 20
+)
+
+// Машинно-читаемые коды ошибок
+const (
+	CodeBadRequest        = "bad_request"
+	CodeInvalidJSON       = "invalid_json"
+	CodeInvalidExpression = "invalid_expression"
+	CodeValidation        = "validation_failed"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeDisabled          = "account_disabled"
+	CodeNotFound          = "not_found"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeConflict          = "conflict"
+	CodeRateLimited       = "rate_limited"
+	CodeQuotaExceeded     = "quota_exceeded"
+	CodeTooLarge          = "payload_too_large"
+	CodeInternal          = "internal"
+)
+
+// Error Ошибка запроса: HTTP статус, код и сообщение для клиента
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Details any
+	// RetryAfter Для 429: через сколько можно повторить запрос
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf Создание ошибки запроса
+func Errorf(status int, code, format string, args ...any) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// AsError Ошибка запроса из любой ошибки, неизвестные ошибки становятся 500 без подробностей
+func AsError(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	log.Println("ERROR: ", err)
+	return &Error{Status: 500, Code: CodeInternal, Message: "internal server error"}
+}
+
+// Write Ответ с данными в конверте {"data": ...}
+func Write(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status == 204 {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(structures.ResponseJSON{Data: data})
+}
+
+// WritePage Ответ со страницей списка в конверте {"data": [...], "page": {...}}
+func WritePage(w http.ResponseWriter, data any, page structures.PageJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_ = json.NewEncoder(w).Encode(structures.ResponseJSON{Data: data, Page: &page})
+}
+
+// WriteError Ответ с ошибкой в конверте {"error": {"code": ..., "message": ...}}
+func WriteError(w http.ResponseWriter, err error) {
+	e := AsError(err)
+	setRetryAfter(w, e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	_ = json.NewEncoder(w).Encode(structures.ResponseJSON{Error: &structures.ErrorJSON{
+		Code:    e.Code,
+		Message: e.Message,
+		Details: e.Details,
+	}})
+}
+
+// WritePlain Ответ с ошибкой текстом, как у старых маршрутов
+func WritePlain(w http.ResponseWriter, err error) {
+	e := AsError(err)
+	setRetryAfter(w, e)
+	http.Error(w, e.Message, e.Status)
+}
+
+func setRetryAfter(w http.ResponseWriter, e *Error) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+}
+
+// LimitBody Ограничение размера тела запроса, лишнее ReadBody и Decode отвергают с 413
+func LimitBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReadBody Чтение тела запроса
+func ReadBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, Errorf(413, CodeTooLarge, "request body is larger than %d bytes", tooLarge.Limit)
+	}
+	if err != nil {
+		return nil, Errorf(400, CodeBadRequest, "cant read body")
+	}
+	return body, nil
+}
+
+// Decode Разбор JSON тела запроса в v
+func Decode(r *http.Request, v any) error {
+	body, err := ReadBody(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &Error{Status: 400, Code: CodeInvalidJSON, Message: "error parsing JSON", Details: err.Error()}
+	}
+	return nil
+}
+
+// Expression Представление выражения в /api/v1: результат только у посчитанных, ошибка только у failed
+func Expression(exp structures.Expression) structures.ExpressionJSON {
+	res := structures.ExpressionJSON{
+		Id:         exp.Id,
+		Expression: exp.Exp,
+		Status:     exp.Status,
+		OwnerId:    exp.UserId,
+		// Ключ есть только у только что добавленного выражения с callback'ом
+		CallbackSecret: exp.CallbackSecret,
+	}
+	if exp.Status == "done" {
+		result := exp.Result
+		res.Result = &result
+	}
+	if exp.Status == "failed" {
+		res.Error = &structures.ErrorJSON{Code: exp.ErrorCode, Message: exp.Error}
+	}
+	if !exp.CreatedAt.IsZero() {
+		createdAt := exp.CreatedAt
+		res.CreatedAt = &createdAt
+	}
+	return res
+}
+
+// Event Представление события в потоке /api/v1/events
+func Event(e structures.Event) structures.EventJSON {
+	res := structures.EventJSON{
+		Id:           e.Id,
+		Type:         e.Type,
+		ExpressionId: e.ExpressionId,
+		OperationId:  e.OperationId,
+		DaemonId:     e.DaemonId,
+		Status:       e.Status,
+		CreatedAt:    e.CreatedAt,
+	}
+	if e.Status == "done" {
+		result := e.Result
+		res.Result = &result
+	}
+	if e.Status == "failed" {
+		res.Error = &structures.ErrorJSON{Code: e.ErrorCode, Message: e.Error}
+	}
+	return res
+}
+
+// WriteEvent Запись события в формате Server-Sent Events: номер события становится его id для Last-Event-ID
+func WriteEvent(w io.Writer, e structures.Event) error {
+	payload, err := json.Marshal(Event(e))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, payload)
+	return err
+}
+
+// Deprecated Пометка старого маршрута устаревшим со ссылкой на замену в /api/v1
+func Deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+Prefix+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
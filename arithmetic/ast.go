@@ -0,0 +1,84 @@
+package arithmetic
+
+import "strconv"
+
+// Op Арифметический оператор
+type Op byte
+
+const (
+	OpAdd Op = '+'
+	OpSub Op = '-'
+	OpMul Op = '*'
+	OpDiv Op = '/'
+)
+
+// Name Название оператора, используется как ключ в длительностях вычисления
+func (o Op) Name() string {
+	switch o {
+	case OpAdd:
+		return "plus"
+	case OpSub:
+		return "minus"
+	case OpMul:
+		return "mul"
+	case OpDiv:
+		return "div"
+	}
+	return ""
+}
+
+// OpByName Оператор по его названию
+func OpByName(name string) (Op, bool) {
+	for _, op := range []Op{OpAdd, OpSub, OpMul, OpDiv} {
+		if op.Name() == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+func (o Op) String() string {
+	return string(o)
+}
+
+// Node Узел AST
+type Node interface {
+	Pos() int
+	String() string
+}
+
+// Number Числовая константа
+type Number struct {
+	Value  float64
+	Offset int
+}
+
+// Unary Унарный минус
+type Unary struct {
+	Op     Op
+	X      Node
+	Offset int
+}
+
+// Binary Бинарная операция
+type Binary struct {
+	Op          Op
+	Left, Right Node
+	Offset      int
+}
+
+func (n *Number) Pos() int { return n.Offset }
+func (n *Unary) Pos() int  { return n.Offset }
+func (n *Binary) Pos() int { return n.Offset }
+
+func (n *Number) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+func (n *Unary) String() string {
+	return "(" + n.Op.String() + n.X.String() + ")"
+}
+
+func (n *Binary) String() string {
+	return "(" + n.Left.String() + " " + n.Op.String() + " " + n.Right.String() + ")"
+}
@@ -0,0 +1,72 @@
+package arithmetic
+
+import (
+	"fmt"
+	"math"
+)
+
+// Коды ошибок вычисления
+const (
+	CodeDivisionByZero   = "division_by_zero"
+	CodeOverflow         = "overflow"
+	CodeNaN              = "nan"
+	CodeUnknownOperation = "unknown_operation"
+	CodeEvaluation       = "evaluation_error"
+)
+
+// EvalError Ошибка вычисления с машиночитаемым кодом
+type EvalError struct {
+	Code    string
+	Message string
+}
+
+func (e *EvalError) Error() string {
+	return e.Message
+}
+
+// Apply Выполнение одной бинарной операции.
+// Деление на ноль, переполнение и NaN возвращаются как EvalError.
+func Apply(op Op, left, right float64) (float64, error) {
+	var res float64
+	switch op {
+	case OpAdd:
+		res = left + right
+	case OpSub:
+		res = left - right
+	case OpMul:
+		res = left * right
+	case OpDiv:
+		if right == 0 {
+			return 0, &EvalError{Code: CodeDivisionByZero, Message: fmt.Sprintf("division by zero: %g / %g", left, right)}
+		}
+		res = left / right
+	default:
+		return 0, &EvalError{Code: CodeUnknownOperation, Message: fmt.Sprintf("unknown operator %q", op)}
+	}
+	if err := CheckFinite(res); err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+// CheckFinite Проверка, что значение конечное
+func CheckFinite(v float64) error {
+	if math.IsNaN(v) {
+		return &EvalError{Code: CodeNaN, Message: "result is not a number"}
+	}
+	if math.IsInf(v, 0) {
+		return &EvalError{Code: CodeOverflow, Message: fmt.Sprintf("result overflow: %g", v)}
+	}
+	return nil
+}
+
+// CheckFloat32 Проверка, что значение конечное и помещается в float32, в котором хранится результат выражения
+func CheckFloat32(v float64) error {
+	if err := CheckFinite(v); err != nil {
+		return err
+	}
+	if math.IsInf(float64(float32(v)), 0) {
+		return &EvalError{Code: CodeOverflow, Message: fmt.Sprintf("result overflow: %g does not fit into float32", v)}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package arithmetic
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Грамматика:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | "(" expr ")"
+
+// Ограничения на вход: разбор и разбиение дерева рекурсивные, без них длинная цепочка скобок
+// или унарных минусов переполняет стек и роняет весь процесс
+const (
+	// MaxLength Максимальная длина выражения в символах
+	MaxLength = 4096
+	// MaxDepth Максимальная вложенность скобок и унарных минусов
+	MaxDepth = 100
+)
+
+type parser struct {
+	tokens []Token
+	pos    int
+	depth  int
+}
+
+// Parse Разбор выражения в AST
+func Parse(s string) (Node, error) {
+	if utf8.RuneCountInString(s) > MaxLength {
+		return nil, &Error{Message: fmt.Sprintf("expression is longer than %d characters", MaxLength), Offset: MaxLength}
+	}
+	tokens, err := Tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().Kind == TokenEOF {
+		return nil, &Error{Message: "empty expression", Offset: 0}
+	}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.Kind != TokenEOF {
+		if t.Kind == TokenRParen {
+			return nil, &Error{Message: "unmatched closing parenthesis", Offset: t.Offset, Token: t.Text}
+		}
+		return nil, &Error{Message: "expected operator", Offset: t.Offset, Token: t.Text}
+	}
+	return n, nil
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() Token {
+	t := p.tokens[p.pos]
+	if t.Kind != TokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expr() (Node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.Kind != TokenPlus && t.Kind != TokenMinus {
+			return left, nil
+		}
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: Op(t.Text[0]), Left: left, Right: right, Offset: t.Offset}
+	}
+}
+
+func (p *parser) term() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.Kind != TokenStar && t.Kind != TokenSlash {
+			return left, nil
+		}
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: Op(t.Text[0]), Left: left, Right: right, Offset: t.Offset}
+	}
+}
+
+// enter Вход во вложенный узел, t - открывающий его токен
+func (p *parser) enter(t Token) error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return &Error{Message: fmt.Sprintf("nesting is deeper than %d", MaxDepth), Offset: t.Offset, Token: t.Text}
+	}
+	return nil
+}
+
+func (p *parser) unary() (Node, error) {
+	if t := p.peek(); t.Kind == TokenMinus {
+		p.next()
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: OpSub, X: x, Offset: t.Offset}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Node, error) {
+	t := p.next()
+	switch t.Kind {
+	case TokenNumber:
+		return &Number{Value: t.Value, Offset: t.Offset}, nil
+	case TokenLParen:
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.peek(); c.Kind != TokenRParen {
+			if c.Kind == TokenEOF {
+				return nil, &Error{Message: "unclosed parenthesis", Offset: t.Offset, Token: t.Text}
+			}
+			return nil, &Error{Message: "expected closing parenthesis", Offset: c.Offset, Token: c.Text}
+		}
+		p.next()
+		return n, nil
+	case TokenEOF:
+		return nil, &Error{Message: "unexpected end of expression", Offset: t.Offset}
+	}
+	return nil, &Error{Message: "expected number or opening parenthesis", Offset: t.Offset, Token: t.Text}
+}
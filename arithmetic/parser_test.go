@@ -0,0 +1,91 @@
+package arithmetic
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"number", "42", "42"},
+		{"fraction", "1.5", "1.5"},
+		{"leading dot", ".5", "0.5"},
+		{"spaces", "  1 +\t2 ", "(1 + 2)"},
+		{"left associative", "1 - 2 - 3", "((1 - 2) - 3)"},
+		{"division left associative", "8 / 4 / 2", "((8 / 4) / 2)"},
+		{"precedence", "1 + 2 * 3", "(1 + (2 * 3))"},
+		{"precedence left", "2 * 3 + 1", "((2 * 3) + 1)"},
+		{"parentheses", "(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"nested parentheses", "((1))", "1"},
+		{"unary minus", "-2", "(-2)"},
+		{"double unary minus", "--2", "(-(-2))"},
+		{"unary binds tighter", "-2 * 3", "((-2) * 3)"},
+		{"unary after operator", "2 * -3", "(2 * (-3))"},
+		{"unary before parentheses", "-(1 + 2)", "(-(1 + 2))"},
+		{"binary then unary", "1 - -1", "(1 - (-1))"},
+		{"deepest nesting", strings.Repeat("(", MaxDepth) + "1" + strings.Repeat(")", MaxDepth), "1"},
+		{"longest expression", strings.Repeat(" ", MaxLength-1) + "1", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(tt.in)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.in, err)
+			}
+			if got := n.String(); got != tt.want {
+				t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		message string
+		offset  int
+		token   string
+	}{
+		{"empty", "", "empty expression", 0, ""},
+		{"only spaces", "   ", "empty expression", 0, ""},
+		{"unexpected character", "1 + a", "unexpected character", 4, "a"},
+		{"offset in characters", "ё+1", "unexpected character", 0, "ё"},
+		{"offset after multibyte", "(ё) + x", "unexpected character", 1, "ё"},
+		{"two dots", "1.2.3 + 1", "malformed number", 0, "1.2.3"},
+		{"lone dot", "1 + .", "malformed number", 4, "."},
+		{"no exponent", "1e", "unexpected character", 1, "e"},
+		{"huge number", "1" + strings.Repeat("0", 400), "number out of range", 0, "1" + strings.Repeat("0", 400)},
+		{"trailing operator", "1 +", "unexpected end of expression", 3, ""},
+		{"double operator", "1 + * 2", "expected number or opening parenthesis", 4, "*"},
+		{"missing operator", "1 2", "expected operator", 2, "2"},
+		{"unmatched closing", "1 + 2)", "unmatched closing parenthesis", 5, ")"},
+		{"unclosed", "(1 + 2", "unclosed parenthesis", 0, "("},
+		{"unclosed inner", "1 * ((2)", "unclosed parenthesis", 4, "("},
+		{"expected closing", "(1 2)", "expected closing parenthesis", 3, "2"},
+		{"empty parentheses", "()", "expected number or opening parenthesis", 1, ")"},
+		{"unary plus", "+1", "expected number or opening parenthesis", 0, "+"},
+		{"too long", strings.Repeat("1+", MaxLength/2) + "1", "expression is longer than 4096 characters", MaxLength, ""},
+		{"too deep parentheses", strings.Repeat("(", MaxDepth+1) + "1" + strings.Repeat(")", MaxDepth+1), "nesting is deeper than 100", MaxDepth, "("},
+		{"too deep unary minus", strings.Repeat("-", MaxDepth+1) + "1", "nesting is deeper than 100", MaxDepth, "-"},
+		{"stack overflow attempt", strings.Repeat("(", 3000000) + "1" + strings.Repeat(")", 3000000), "expression is longer than 4096 characters", MaxLength, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.in)
+			var perr *Error
+			if !errors.As(err, &perr) {
+				t.Fatalf("Parse(%q) error = %v, want *Error", tt.in, err)
+			}
+			if perr.Message != tt.message || perr.Offset != tt.offset || perr.Token != tt.token {
+				t.Errorf("Parse(%q) = {%q, %d, %q}, want {%q, %d, %q}",
+					tt.in, perr.Message, perr.Offset, perr.Token, tt.message, tt.offset, tt.token)
+			}
+		})
+	}
+}
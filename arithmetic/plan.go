@@ -0,0 +1,71 @@
+package arithmetic
+
+// Side Операнд родительской операции, в который идет результат
+type Side string
+
+const (
+	SideLeft  Side = "left"
+	SideRight Side = "right"
+)
+
+// Step Одна бинарная операция после разбиения дерева.
+// Операнд равен nil, если его значение дает другая операция.
+type Step struct {
+	Index  int
+	Parent int
+	Side   Side
+	Op     Op
+	Left   *float64
+	Right  *float64
+}
+
+// Ready Оба операнда известны, операцию можно отправлять на вычисление
+func (s Step) Ready() bool {
+	return s.Left != nil && s.Right != nil
+}
+
+// Decompose Разбиение дерева на бинарные операции.
+// Корень идет первым и имеет Parent == -1. Если операций нет (выражение - константа),
+// возвращается ее значение. Унарный минус над константой сворачивается,
+// над подвыражением превращается в 0 - x.
+func Decompose(n Node) ([]Step, float64) {
+	var steps []Step
+	var walk func(n Node, parent int, side Side) *float64
+	walk = func(n Node, parent int, side Side) *float64 {
+		if v, ok := constant(n); ok {
+			return &v
+		}
+		b := binary(n)
+		idx := len(steps)
+		steps = append(steps, Step{Index: idx, Parent: parent, Side: side, Op: b.Op})
+		left := walk(b.Left, idx, SideLeft)
+		right := walk(b.Right, idx, SideRight)
+		steps[idx].Left, steps[idx].Right = left, right
+		return nil
+	}
+	if v := walk(n, -1, ""); v != nil {
+		return nil, *v
+	}
+	return steps, 0
+}
+
+// constant Значение узла, если это число или цепочка унарных минусов над числом
+func constant(n Node) (float64, bool) {
+	switch n := n.(type) {
+	case *Number:
+		return n.Value, true
+	case *Unary:
+		if v, ok := constant(n.X); ok {
+			return -v, true
+		}
+	}
+	return 0, false
+}
+
+// binary Приведение не-константного узла к бинарной операции
+func binary(n Node) *Binary {
+	if u, ok := n.(*Unary); ok {
+		return &Binary{Op: OpSub, Left: &Number{Offset: u.Offset}, Right: u.X, Offset: u.Offset}
+	}
+	return n.(*Binary)
+}
@@ -0,0 +1,86 @@
+package arithmetic
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func num(v float64) *float64 {
+	return &v
+}
+
+func TestDecompose(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		steps []Step
+		value float64
+	}{
+		{"constant", "42", nil, 42},
+		{"negative constant", "-3", nil, -3},
+		{"folded unary minus", "--(3)", nil, 3},
+		{"single operation", "1 + 2", []Step{
+			{Index: 0, Parent: -1, Op: OpAdd, Left: num(1), Right: num(2)},
+		}, 0},
+		{"unary minus over constant", "2 * -3", []Step{
+			{Index: 0, Parent: -1, Op: OpMul, Left: num(2), Right: num(-3)},
+		}, 0},
+		{"unary minus over subexpression", "-(1 + 2)", []Step{
+			{Index: 0, Parent: -1, Op: OpSub, Left: num(0), Right: nil},
+			{Index: 1, Parent: 0, Side: SideRight, Op: OpAdd, Left: num(1), Right: num(2)},
+		}, 0},
+		{"precedence", "1 + 2 * 3", []Step{
+			{Index: 0, Parent: -1, Op: OpAdd, Left: num(1), Right: nil},
+			{Index: 1, Parent: 0, Side: SideRight, Op: OpMul, Left: num(2), Right: num(3)},
+		}, 0},
+		{"both sides", "(1 - 2) / (3 * 4)", []Step{
+			{Index: 0, Parent: -1, Op: OpDiv},
+			{Index: 1, Parent: 0, Side: SideLeft, Op: OpSub, Left: num(1), Right: num(2)},
+			{Index: 2, Parent: 0, Side: SideRight, Op: OpMul, Left: num(3), Right: num(4)},
+		}, 0},
+		{"chain", "1 - 2 - 3", []Step{
+			{Index: 0, Parent: -1, Op: OpSub, Left: nil, Right: num(3)},
+			{Index: 1, Parent: 0, Side: SideLeft, Op: OpSub, Left: num(1), Right: num(2)},
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(tt.in)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.in, err)
+			}
+			steps, value := Decompose(n)
+			if !reflect.DeepEqual(steps, tt.steps) {
+				t.Errorf("Decompose(%q) steps = %s, want %s", tt.in, format(steps), format(tt.steps))
+			}
+			if value != tt.value {
+				t.Errorf("Decompose(%q) value = %v, want %v", tt.in, value, tt.value)
+			}
+		})
+	}
+}
+
+func TestStepReady(t *testing.T) {
+	if (Step{Left: num(1)}).Ready() {
+		t.Error("step with one operand is ready")
+	}
+	if !(Step{Left: num(1), Right: num(2)}).Ready() {
+		t.Error("step with both operands is not ready")
+	}
+}
+
+// format Шаги с разыменованными операндами, чтобы в сообщении были значения, а не адреса
+func format(steps []Step) string {
+	operand := func(v *float64) string {
+		if v == nil {
+			return "_"
+		}
+		return fmt.Sprint(*v)
+	}
+	s := "["
+	for _, st := range steps {
+		s += fmt.Sprintf("{%d: %s %s %s parent=%d %s}", st.Index, operand(st.Left), st.Op, operand(st.Right), st.Parent, st.Side)
+	}
+	return s + "]"
+}
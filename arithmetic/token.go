@@ -0,0 +1,104 @@
+package arithmetic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// TokenKind Тип токена
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNumber
+	TokenPlus
+	TokenMinus
+	TokenStar
+	TokenSlash
+	TokenLParen
+	TokenRParen
+)
+
+// Token Токен выражения
+type Token struct {
+	Kind   TokenKind
+	Text   string
+	Value  float64
+	Offset int
+}
+
+// Error Ошибка разбора выражения с позицией символа и проблемным токеном
+type Error struct {
+	Message string
+	Offset  int
+	Token   string
+}
+
+func (e *Error) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at offset %d", e.Message, e.Offset)
+	}
+	return fmt.Sprintf("%s at offset %d (%q)", e.Message, e.Offset, e.Token)
+}
+
+// Tokenize Разбиение выражения на токены, позиции считаются в символах
+func Tokenize(s string) ([]Token, error) {
+	src := []rune(s)
+	var tokens []Token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '+':
+			tokens = append(tokens, Token{Kind: TokenPlus, Text: "+", Offset: i})
+			i++
+		case c == '-':
+			tokens = append(tokens, Token{Kind: TokenMinus, Text: "-", Offset: i})
+			i++
+		case c == '*':
+			tokens = append(tokens, Token{Kind: TokenStar, Text: "*", Offset: i})
+			i++
+		case c == '/':
+			tokens = append(tokens, Token{Kind: TokenSlash, Text: "/", Offset: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, Token{Kind: TokenLParen, Text: "(", Offset: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, Token{Kind: TokenRParen, Text: ")", Offset: i})
+			i++
+		case isDigit(c) || c == '.':
+			start := i
+			dots := 0
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				if src[i] == '.' {
+					dots++
+				}
+				i++
+			}
+			text := string(src[start:i])
+			if dots > 1 || text == "." {
+				return nil, &Error{Message: "malformed number", Offset: start, Token: text}
+			}
+			v, err := strconv.ParseFloat(text, 64)
+			if errors.Is(err, strconv.ErrRange) {
+				return nil, &Error{Message: "number out of range", Offset: start, Token: text}
+			}
+			if err != nil {
+				return nil, &Error{Message: "malformed number", Offset: start, Token: text}
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: text, Value: v, Offset: start})
+		default:
+			return nil, &Error{Message: "unexpected character", Offset: i, Token: string(c)}
+		}
+	}
+	tokens = append(tokens, Token{Kind: TokenEOF, Offset: len(src)})
+	return tokens, nil
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
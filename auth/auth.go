@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/j0pl0p/final-task-GO-YL/api"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken Токен не прошел проверку
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrInvalidKey API ключ неизвестен или отозван
+var ErrInvalidKey = errors.New("invalid api key")
+
+// ErrDisabled Пользователь заблокирован администратором
+var ErrDisabled = errors.New("account disabled")
+
+// RoleAdmin Роль администратора
+const RoleAdmin = "admin"
+
+// Права доступа. Вход по паролю дает ScopeSession, которая включает остальные;
+// API ключ дает ScopeRead или ScopeSubmit (включает ScopeRead).
+const (
+	ScopeSession = "session"
+	ScopeSubmit  = "submit"
+	ScopeRead    = "read"
+)
+
+// APIKeyPrefix Префикс, по которому API ключ отличается от JWT
+const APIKeyPrefix = "ak_"
+
+// User Аутентифицированный пользователь запроса
+type User struct {
+	Id       string
+	Login    string
+	Role     string
+	Scope    string
+	APIKeyId string
+}
+
+// Can Есть ли у пользователя право scope
+func (u User) Can(scope string) bool {
+	switch u.Scope {
+	case ScopeSession:
+		return true
+	case ScopeSubmit:
+		return scope == ScopeSubmit || scope == ScopeRead
+	case ScopeRead:
+		return scope == ScopeRead
+	}
+	return false
+}
+
+// KeyLookup Поиск владельца API ключа по хешу ключа
+type KeyLookup func(hash string) (User, error)
+
+// UserCheck Проверка пользователя по хранилищу на каждом запросе: роль, блокировка.
+// Нужна, потому что JWT не отзывается до конца срока действия.
+type UserCheck func(u User) (User, error)
+
+// ErrorWriter Запись ответа с ошибкой аутентификации (*api.Error)
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, err error)
+
+// Claims Содержимое access токена
+type Claims struct {
+	Login string `json:"login"`
+	jwt.RegisteredClaims
+}
+
+// Authenticator Выдача и проверка access токенов и API ключей
+type Authenticator struct {
+	secret []byte
+	ttl    time.Duration
+	keys   KeyLookup
+	users  UserCheck
+	errors ErrorWriter
+}
+
+type contextKey struct{}
+
+// NewAuthenticator Создание аутентификатора с ключом подписи и временем жизни токена
+func NewAuthenticator(secret []byte, ttl time.Duration) *Authenticator {
+	return &Authenticator{secret: secret, ttl: ttl, errors: func(w http.ResponseWriter, _ *http.Request, err error) {
+		api.WritePlain(w, err)
+	}}
+}
+
+// SetErrorWriter Свой формат ответов 401 и 403
+func (a *Authenticator) SetErrorWriter(write ErrorWriter) {
+	a.errors = write
+}
+
+// SetKeyLookup Включение входа по API ключам
+func (a *Authenticator) SetKeyLookup(keys KeyLookup) {
+	a.keys = keys
+}
+
+// SetUserCheck Включение проверки пользователя по хранилищу
+func (a *Authenticator) SetUserCheck(users UserCheck) {
+	a.users = users
+}
+
+// TTL Время жизни выдаваемых токенов
+func (a *Authenticator) TTL() time.Duration {
+	return a.ttl
+}
+
+// Issue Выдача подписанного access токена
+func (a *Authenticator) Issue(u User) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Login: u.Login,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   u.Id,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+// Parse Проверка подписи и срока действия токена
+func (a *Authenticator) Parse(token string) (User, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return User{}, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return User{}, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return User{Id: claims.Subject, Login: claims.Login, Scope: ScopeSession}, nil
+}
+
+// Authenticate Проверка заголовка Authorization: Bearer <jwt> или ApiKey <ключ>
+func (a *Authenticator) Authenticate(header string) (User, error) {
+	scheme, credential, _ := strings.Cut(header, " ")
+	if credential == "" {
+		return User{}, fmt.Errorf("%w: missing credentials", ErrInvalidToken)
+	}
+	var u User
+	var err error
+	switch {
+	case scheme == "ApiKey" || (scheme == "Bearer" && strings.HasPrefix(credential, APIKeyPrefix)):
+		if a.keys == nil {
+			return User{}, ErrInvalidKey
+		}
+		u, err = a.keys(HashAPIKey(credential))
+	case scheme == "Bearer":
+		u, err = a.Parse(credential)
+	default:
+		err = fmt.Errorf("%w: unsupported scheme %q", ErrInvalidToken, scheme)
+	}
+	if err != nil || a.users == nil {
+		return u, err
+	}
+	return a.users(u)
+}
+
+// Check Проверка заголовка Authorization и права scope. Ошибка - api.Error с 401 или 403.
+func (a *Authenticator) Check(header, scope string) (User, error) {
+	u, err := a.Authenticate(header)
+	if errors.Is(err, ErrDisabled) {
+		log.Println("ERROR: disabled account: ", u.Login)
+		return u, api.Errorf(403, api.CodeDisabled, "account disabled")
+	}
+	if err != nil {
+		log.Println("ERROR: unauthorized: ", err.Error())
+		return u, api.Errorf(401, api.CodeUnauthorized, "unauthorized")
+	}
+	if !u.Can(scope) {
+		log.Println("ERROR: forbidden: ", u.Login, "has", u.Scope, "needs", scope)
+		return u, api.Errorf(403, api.CodeForbidden, "forbidden: %s scope required", scope)
+	}
+	return u, nil
+}
+
+// Require Пропускает только аутентифицированные запросы с правом scope
+func (a *Authenticator) Require(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := a.Check(r.Header.Get("Authorization"), scope)
+		if err != nil {
+			if api.AsError(err).Status == 401 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="orchestrator"`)
+			}
+			a.errors(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), u)))
+	})
+}
+
+// RequireAdmin Пропускает только администраторов, вошедших по паролю
+func (a *Authenticator) RequireAdmin(next http.Handler) http.Handler {
+	return a.Require(ScopeSession, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		if u.Role != RoleAdmin {
+			a.errors(w, r, api.Errorf(403, api.CodeForbidden, "forbidden: admin role required"))
+			log.Println("ERROR: forbidden: ", u.Login, "is not an admin")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// NewAPIKey Генерация API ключа. Пользователю отдается key, хранится только hash.
+func NewAPIKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey Хеш API ключа для хранения и поиска. Ключ случайный и длинный, поэтому хватает SHA-256.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithUser Контекст с пользователем запроса
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, contextKey{}, u)
+}
+
+// UserFromContext Пользователь запроса, положенный Middleware
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(contextKey{}).(User)
+	return u, ok
+}
+
+// HashPassword Хеширование пароля bcrypt
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword Сравнение пароля с bcrypt хешем
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
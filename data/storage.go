@@ -1,11 +1,17 @@
 package data
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/j0pl0p/final-task-GO-YL/structures"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"log"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -15,6 +21,18 @@ type DatabaseHost interface {
 	GetById(id string) (structures.Expression, bool)
 }
 
+// ErrOperationDone Результат операции уже сохранен, повторный результат нужно игнорировать
+var ErrOperationDone = errors.New("operation already done")
+
+// ErrOperationNotFound Операции нет: выражение удалено, пока операция считалась
+var ErrOperationNotFound = errors.New("operation not found")
+
+// ErrOperationCancelled Выражение операции отменено или уже упало, ее результат не нужен
+var ErrOperationCancelled = errors.New("operation cancelled")
+
+// ErrUserExists Пользователь с таким логином уже есть
+var ErrUserExists = errors.New("user already exists")
+
 // Storage Структура хранилища
 type Storage struct {
 	Db *sqlx.DB
@@ -33,69 +51,526 @@ CREATE TABLE IF NOT EXISTS Daemons (
 	status VARCHAR(256) DEFAULT 'active',
     last_response DATETIME
 );
+
+CREATE TABLE IF NOT EXISTS Users (
+	id VARCHAR(256) PRIMARY KEY UNIQUE,
+	login VARCHAR(256) UNIQUE,
+	password_hash VARCHAR(256),
+	created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS ApiKeys (
+	id VARCHAR(256) PRIMARY KEY UNIQUE,
+	user_id VARCHAR(256),
+	name VARCHAR(256),
+	prefix VARCHAR(16),
+	key_hash VARCHAR(64) UNIQUE,
+	scope VARCHAR(16),
+	created_at DATETIME,
+	last_used_at DATETIME,
+	revoked_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS Usage (
+	user_id VARCHAR(256),
+	day VARCHAR(10),
+	operations INTEGER DEFAULT 0,
+	PRIMARY KEY (user_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS Reassignments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	operation_id VARCHAR(256),
+	expression_id VARCHAR(256),
+	from_daemon VARCHAR(256),
+	reassigned_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS Batches (
+	id VARCHAR(256) PRIMARY KEY UNIQUE,
+	user_id VARCHAR(256),
+	total INTEGER DEFAULT 0,
+	rejected INTEGER DEFAULT 0,
+	created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS BatchItems (
+	batch_id VARCHAR(256),
+	position INTEGER,
+	expression_id VARCHAR(256) DEFAULT '',
+	duplicate BOOLEAN DEFAULT FALSE,
+	error_code VARCHAR(64) DEFAULT '',
+	error VARCHAR(256) DEFAULT '',
+	PRIMARY KEY (batch_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS Events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type VARCHAR(64),
+	user_id VARCHAR(256) DEFAULT '',
+	expression_id VARCHAR(256) DEFAULT '',
+	operation_id VARCHAR(256) DEFAULT '',
+	daemon_id VARCHAR(256) DEFAULT '',
+	status VARCHAR(256) DEFAULT '',
+	result FLOAT(32) DEFAULT 0.0,
+	error_code VARCHAR(64) DEFAULT '',
+	error VARCHAR(256) DEFAULT '',
+	created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS Webhooks (
+	expression_id VARCHAR(256) PRIMARY KEY UNIQUE,
+	url VARCHAR(2048),
+	secret VARCHAR(64) DEFAULT '',
+	state VARCHAR(16) DEFAULT 'pending',
+	attempts INTEGER DEFAULT 0,
+	next_attempt_at DATETIME,
+	delivered_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS WebhookAttempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id VARCHAR(256),
+	attempt INTEGER,
+	status_code INTEGER DEFAULT 0,
+	error VARCHAR(256) DEFAULT '',
+	duration_ms INTEGER DEFAULT 0,
+	created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS Operations (
+	id VARCHAR(256) PRIMARY KEY UNIQUE,
+	expression_id VARCHAR(256),
+	parent_id VARCHAR(256) DEFAULT '',
+	side VARCHAR(8) DEFAULT '',
+	operation VARCHAR(8),
+	left_value DOUBLE DEFAULT 0.0,
+	right_value DOUBLE DEFAULT 0.0,
+	left_ready BOOLEAN DEFAULT FALSE,
+	right_ready BOOLEAN DEFAULT FALSE,
+	status VARCHAR(256) DEFAULT 'waiting',
+	result DOUBLE DEFAULT 0.0
+);
 `
 
+// migrations Изменения схемы для уже созданных баз, повторное применение пропускается
+var migrations = []string{
+	`ALTER TABLE Expressions ADD COLUMN error VARCHAR(256) DEFAULT ''`,
+	`ALTER TABLE Expressions ADD COLUMN error_code VARCHAR(64) DEFAULT ''`,
+	`ALTER TABLE Operations ADD COLUMN daemon_id VARCHAR(256) DEFAULT ''`,
+	`ALTER TABLE Operations ADD COLUMN picked_at DATETIME`,
+	`ALTER TABLE Expressions ADD COLUMN created_at DATETIME`,
+	`ALTER TABLE Expressions ADD COLUMN deadline DATETIME`,
+	`ALTER TABLE Expressions ADD COLUMN attempts INTEGER DEFAULT 0`,
+	`ALTER TABLE Expressions ADD COLUMN max_attempts INTEGER DEFAULT 3`,
+	`ALTER TABLE Expressions ADD COLUMN user_id VARCHAR(256) DEFAULT ''`,
+	`ALTER TABLE Expressions ADD COLUMN exp_hash VARCHAR(64) DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS expressions_user_id ON Expressions (user_id)`,
+	`CREATE INDEX IF NOT EXISTS expressions_exp_hash ON Expressions (exp_hash)`,
+	`ALTER TABLE Users ADD COLUMN role VARCHAR(16) DEFAULT 'user'`,
+	`ALTER TABLE Users ADD COLUMN disabled BOOLEAN DEFAULT FALSE`,
+	`CREATE INDEX IF NOT EXISTS events_user_id ON Events (user_id, id)`,
+	`CREATE INDEX IF NOT EXISTS webhooks_state ON Webhooks (state)`,
+	`CREATE INDEX IF NOT EXISTS webhook_attempts_expression_id ON WebhookAttempts (expression_id)`,
+	`ALTER TABLE Daemons ADD COLUMN signing_key VARCHAR(64) DEFAULT ''`,
+	// Callback'и, оставшиеся от выражений, которые так и не добавились
+	`DELETE FROM Webhooks WHERE expression_id NOT IN (SELECT id FROM Expressions)`,
+	`ALTER TABLE Webhooks ADD COLUMN secret VARCHAR(64) DEFAULT ''`,
+}
+
+// timeLayout Формат времени в базе: UTC и всегда три знака миллисекунд. Драйвер по умолчанию пишет время
+// в локальной зоне и без нулей в конце дробной части, и при сравнении строк ...05.1 оказывается позже ...05.123.
+const timeLayout = "2006-01-02 15:04:05.000-07:00"
+
+// dbTime Время для записи в базу и сравнения с колонками DATETIME
+func dbTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// timeColumns Колонки со временем, которые migrations переводят в timeLayout
+var timeColumns = []string{
+	"Expressions.created_at", "Expressions.deadline", "Daemons.last_response", "Users.created_at",
+	"ApiKeys.created_at", "ApiKeys.last_used_at", "ApiKeys.revoked_at", "Reassignments.reassigned_at",
+	"Batches.created_at", "Events.created_at", "Webhooks.next_attempt_at", "Webhooks.delivered_at",
+	"WebhookAttempts.created_at", "Operations.picked_at",
+}
+
 // NewStorage Создание нового хранилища
 func NewStorage(path string) (*Storage, error) {
-	db, err := sqlx.Connect("sqlite3", path)
-
-	db.MustExec(newDbInit)
+	// Транзакции сразу берут блокировку на запись: иначе две транзакции, прочитавшие данные,
+	// не могут обе перейти к записи, и одна из них падает с "database is locked" без ожидания
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sqlx.Connect("sqlite3", path+sep+"_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("cant open database: %w", err)
 	}
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("cant connect to database: %w", err)
 	}
+	db.MustExec(newDbInit)
+	for _, m := range migrations {
+		if _, err := db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, fmt.Errorf("cant migrate database: %w", err)
+		}
+	}
+	for _, c := range timeColumns {
+		table, column, _ := strings.Cut(c, ".")
+		migrateTimeSQL := `UPDATE ` + table + ` SET ` + column + `=strftime('%Y-%m-%d %H:%M:%f+00:00', ` + column + `)
+			WHERE ` + column + ` IS NOT NULL AND ` + column + ` NOT LIKE '____-__-__ __:__:__.___+00:00'`
+		if _, err := db.Exec(migrateTimeSQL); err != nil {
+			return nil, fmt.Errorf("cant migrate %s: %w", c, err)
+		}
+	}
 	return &Storage{Db: db}, nil
 }
 
-// AddExpression Добавление выражения
-func (s *Storage) AddExpression(id, exp string) (string, error) {
-	addNewExpressionSQL := `INSERT INTO Expressions (id, expression) VALUES (?, ?)`
-	_, err := s.Db.Exec(addNewExpressionSQL, id, exp)
+// AddExpression Добавление выражения вместе с его операциями и callback'ом одной транзакцией.
+// Операции списываются из квоты quota в той же транзакции, так что выражение без списания (и списание без выражения)
+// не остается. Если выражение с таким id уже есть, ничего не добавляется и не списывается, возвращается false.
+// Квоты не хватает - *QuotaError.
+func (s *Storage) AddExpression(exp NewExpression, quota Quota) (bool, error) {
+	tx, err := s.Db.Begin()
 	if err != nil {
-		log.Println("ERROR: ", err)
-		return "", err
+		return false, err
 	}
-	return id, nil
+	defer tx.Rollback()
+	added, err := insertExpression(tx, exp, time.Now())
+	if err != nil || !added {
+		return false, err
+	}
+	if err := consumeQuota(tx, quota, len(exp.Operations)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-// GetAllExpressions Получение всех выражений
-func (s *Storage) GetAllExpressions() ([]structures.Expression, error) {
-	var ans []structures.Expression
-	getAllExpressionsSQL := `SELECT * FROM Expressions`
-	res, err := s.Db.Query(getAllExpressionsSQL)
+// insertExpression Вставка выражения с операциями и callback'ом (если у него есть URL) в транзакции tx.
+// false - выражение с таким id уже есть, тогда не вставляется ничего.
+func insertExpression(tx *sql.Tx, exp NewExpression, now time.Time) (bool, error) {
+	addExpressionSQL := `INSERT INTO Expressions (id, expression, created_at, user_id, exp_hash, status, result)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`
+	addOperationSQL := `INSERT INTO Operations
+		(id, expression_id, parent_id, side, operation, left_value, right_value, left_ready, right_ready, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	addWebhookSQL := `INSERT INTO Webhooks (expression_id, url, secret) VALUES (?, ?, ?)`
+	status := "active"
+	if exp.Cached {
+		status = "done"
+	}
+	res, err := tx.Exec(addExpressionSQL, exp.Id, exp.Exp, dbTime(now), exp.UserId, exp.ExpHash, status, exp.Result)
 	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if exp.Callback.URL != "" {
+		if _, err := tx.Exec(addWebhookSQL, exp.Id, exp.Callback.URL, exp.Callback.Secret); err != nil {
+			return false, err
+		}
+	}
+	for _, op := range exp.Operations {
+		_, err = tx.Exec(addOperationSQL, op.Id, op.ExpressionId, op.ParentId, op.Side, op.Operation,
+			op.Left, op.Right, op.LeftReady, op.RightReady, op.Status)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// FindCachedResult Поиск готового результата такого же выражения у любого пользователя
+func (s *Storage) FindCachedResult(expHash string) (float32, bool) {
+	findCachedSQL := `SELECT result FROM Expressions WHERE exp_hash=? AND status='done' LIMIT 1`
+	var result float32
+	err := s.Db.QueryRow(findCachedSQL, expHash).Scan(&result)
+	if err != nil {
+		return 0, false
+	}
+	return result, true
+}
+
+// ExpressionQuery Параметры выборки выражений: фильтры, сортировка и курсор следующей страницы
+type ExpressionQuery struct {
+	UserId string   // пусто - выражения всех пользователей
+	Status []string // любой из статусов
+	From   time.Time
+	To     time.Time
+	Search string // подстрока текста выражения
+	Sort   string // created_at, status, expression или result
+	Desc   bool
+	Cursor string
+	Limit  int // 0 - без ограничения
+}
+
+// ErrInvalidCursor Курсор поврежден или выдан для другой сортировки
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// expressionSortColumns Разрешенные сортировки, created_at идет в порядке вставки (rowid)
+var expressionSortColumns = map[string]string{
+	"created_at": "",
+	"status":     "status",
+	"expression": "expression",
+	"result":     "result",
+}
+
+// IsExpressionSort Поддерживается ли сортировка выражений по полю
+func IsExpressionSort(sort string) bool {
+	_, ok := expressionSortColumns[sort]
+	return ok
+}
+
+// expressionCursor Последняя строка страницы: значение колонки сортировки и rowid для равных значений
+type expressionCursor struct {
+	Sort  string `json:"s"`
+	Value any    `json:"v,omitempty"`
+	Row   int64  `json:"r"`
+}
+
+// ListExpressions Страница выражений по запросу q и курсор следующей страницы (пустой, если это последняя)
+func (s *Storage) ListExpressions(q ExpressionQuery) ([]structures.Expression, string, error) {
+	if q.Sort == "" {
+		q.Sort = "created_at"
+	}
+	column, ok := expressionSortColumns[q.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	var where []string
+	var args []any
+	if q.UserId != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserId)
+	}
+	if len(q.Status) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(q.Status)-1)+")")
+		for _, status := range q.Status {
+			args = append(args, status)
+		}
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, dbTime(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, dbTime(q.To))
+	}
+	if q.Search != "" {
+		where = append(where, `expression LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(q.Search)+"%")
+	}
+	order, cmp := "ASC", ">"
+	if q.Desc {
+		order, cmp = "DESC", "<"
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort {
+			return nil, "", ErrInvalidCursor
+		}
+		if column == "" {
+			where = append(where, "rowid "+cmp+" ?")
+			args = append(args, c.Row)
+		} else {
+			where = append(where, "("+column+" "+cmp+" ? OR ("+column+" = ? AND rowid "+cmp+" ?))")
+			args = append(args, c.Value, c.Value, c.Row)
+		}
+	}
+	listExpressionsSQL := `SELECT rowid, id, expression, status, result, error, error_code, user_id, created_at FROM Expressions`
+	if len(where) > 0 {
+		listExpressionsSQL += " WHERE " + strings.Join(where, " AND ")
+	}
+	if column != "" {
+		listExpressionsSQL += " ORDER BY " + column + " " + order + ", rowid " + order
+	} else {
+		listExpressionsSQL += " ORDER BY rowid " + order
+	}
+	if q.Limit > 0 {
+		// Одна лишняя строка показывает, что есть следующая страница
+		listExpressionsSQL += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+	rows, err := s.Db.Query(listExpressionsSQL, args...)
+	if err != nil {
+		log.Println("ERROR: ", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	ans := []structures.Expression{}
+	var rowids []int64
+	for rows.Next() {
+		var rowid int64
+		var exp structures.Expression
+		var createdAt sql.NullTime
+		err := rows.Scan(&rowid, &exp.Id, &exp.Exp, &exp.Status, &exp.Result, &exp.Error, &exp.ErrorCode, &exp.UserId, &createdAt)
+		if err != nil {
+			log.Println("ERROR: ", err)
+			return nil, "", err
+		}
+		exp.CreatedAt = createdAt.Time
+		ans = append(ans, exp)
+		rowids = append(rowids, rowid)
+	}
+	if err := rows.Err(); err != nil {
 		log.Println("ERROR: ", err)
+		return nil, "", err
+	}
+	if q.Limit <= 0 || len(ans) <= q.Limit {
+		return ans, "", nil
+	}
+	ans = ans[:q.Limit]
+	last := ans[q.Limit-1]
+	next := expressionCursor{Sort: q.Sort, Row: rowids[q.Limit-1]}
+	switch q.Sort {
+	case "status":
+		next.Value = last.Status
+	case "expression":
+		next.Value = last.Exp
+	case "result":
+		next.Value = float64(last.Result)
+	}
+	return ans, encodeCursor(next), nil
+}
+
+// likeEscaper Экранирование спецсимволов LIKE в строке поиска
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func encodeCursor(c expressionCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (expressionCursor, error) {
+	var c expressionCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// NewExpression Новое выражение: с операциями или, если Cached, сразу с результатом
+type NewExpression struct {
+	Id         string
+	Exp        string
+	UserId     string
+	ExpHash    string
+	Cached     bool
+	Result     float32
+	Operations []structures.Operation
+	// Callback Куда отправить результат и ключ подписи, пустой URL - никуда
+	Callback structures.Webhook
+}
+
+// AddBatch Добавление пачки одной транзакцией: сама пачка, ее элементы, новые выражения, их операции и callback'ы.
+// Операции всех добавленных выражений списываются из квоты quota в той же транзакции (не хватает - *QuotaError).
+// Выражения, которые уже есть (например, добавлены одновременно с пачкой), пропускаются, а их элементы
+// помечаются как повторы, в том числе в items. Возвращает добавленные выражения.
+func (s *Storage) AddBatch(batch structures.Batch, items []structures.BatchItem, exps []NewExpression, quota Quota) ([]NewExpression, error) {
+	addBatchSQL := `INSERT INTO Batches (id, user_id, total, rejected, created_at) VALUES (?, ?, ?, ?, ?)`
+	addItemSQL := `INSERT INTO BatchItems (batch_id, position, expression_id, duplicate, error_code, error)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	tx, err := s.Db.Begin()
+	if err != nil {
 		return nil, err
 	}
-	defer res.Close()
-	for res.Next() {
-		var id string
-		var expression string
+	defer tx.Rollback()
+	var added []NewExpression
+	existing := map[string]bool{}
+	ops := 0
+	for _, exp := range exps {
+		ok, err := insertExpression(tx, exp, batch.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			existing[exp.Id] = true
+			continue
+		}
+		added = append(added, exp)
+		ops += len(exp.Operations)
+	}
+	if err := consumeQuota(tx, quota, ops); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(addBatchSQL, batch.Id, batch.UserId, batch.Total, batch.Rejected, dbTime(batch.CreatedAt))
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if existing[item.ExpressionId] {
+			items[i].Duplicate = true
+		}
+		_, err = tx.Exec(addItemSQL, batch.Id, item.Position, item.ExpressionId, items[i].Duplicate, item.ErrorCode, item.Error)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return added, tx.Commit()
+}
+
+// GetBatch Получение пачки по ее ID
+func (s *Storage) GetBatch(id string) (structures.Batch, bool) {
+	getBatchSQL := `SELECT id, user_id, total, rejected, created_at FROM Batches WHERE id=?`
+	var b structures.Batch
+	err := s.Db.QueryRow(getBatchSQL, id).Scan(&b.Id, &b.UserId, &b.Total, &b.Rejected, &b.CreatedAt)
+	if err != nil {
+		return structures.Batch{}, false
+	}
+	return b, true
+}
+
+// GetBatchCounts Число выражений пачки в каждом статусе, удаленные выражения не считаются
+func (s *Storage) GetBatchCounts(id string) (map[string]int, error) {
+	getCountsSQL := `SELECT e.status, COUNT(*) FROM BatchItems b JOIN Expressions e ON e.id = b.expression_id
+		WHERE b.batch_id=? GROUP BY e.status`
+	rows, err := s.Db.Query(getCountsSQL, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
 		var status string
-		var result float32
-		if err = res.Scan(&id, &expression, &status, &result); err != nil {
-			log.Println("ERROR: ", err)
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
 			return nil, err
 		}
-		ans = append(ans, structures.Expression{
-			Id:     id,
-			Exp:    expression,
-			Status: status,
-			Result: result,
-		})
+		counts[status] = n
 	}
-	if err := res.Err(); err != nil {
-		log.Println("ERROR: ", err)
+	return counts, rows.Err()
+}
+
+// GetBatchItems Элементы пачки по порядку с текущими статусами выражений
+func (s *Storage) GetBatchItems(id string) ([]structures.BatchItem, error) {
+	getItemsSQL := `SELECT b.position, b.expression_id, b.duplicate, b.error_code, b.error, COALESCE(e.status, '')
+		FROM BatchItems b LEFT JOIN Expressions e ON e.id = b.expression_id
+		WHERE b.batch_id=? ORDER BY b.position`
+	rows, err := s.Db.Query(getItemsSQL, id)
+	if err != nil {
 		return nil, err
 	}
-	return ans, nil
+	defer rows.Close()
+	var items []structures.BatchItem
+	for rows.Next() {
+		var item structures.BatchItem
+		err := rows.Scan(&item.Position, &item.ExpressionId, &item.Duplicate, &item.ErrorCode, &item.Error, &item.Status)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
 }
 
 // GetExpressionById Получение выражения по его ID
 func (s *Storage) GetExpressionById(id string) (structures.Expression, bool) {
-	getDataById := `SELECT id, expression, status, result FROM Expressions WHERE id=?`
+	getDataById := `SELECT id, expression, status, result, error, error_code, user_id, created_at FROM Expressions WHERE id=?`
 	q, err := s.Db.Prepare(getDataById)
 	if err != nil {
 		log.Println("ERROR: ", err.Error())
@@ -103,37 +578,98 @@ func (s *Storage) GetExpressionById(id string) (structures.Expression, bool) {
 	}
 	defer q.Close()
 	var exp structures.Expression
-	err = q.QueryRow(id).Scan(&exp.Id, &exp.Exp, &exp.Status, &exp.Result)
+	var createdAt sql.NullTime
+	err = q.QueryRow(id).Scan(&exp.Id, &exp.Exp, &exp.Status, &exp.Result, &exp.Error, &exp.ErrorCode, &exp.UserId, &createdAt)
 	if err != nil {
 		log.Println("ERROR: ", err.Error())
 		return structures.Expression{}, false
 	}
+	exp.CreatedAt = createdAt.Time
 	return exp, true
 }
 
-// AddNewDaemon Добавление нового демона
-func (s *Storage) AddNewDaemon(id string) error {
-	addNewDaemonSQL := `INSERT INTO Daemons (id, status, last_response) VALUES (?, 'active', ?)`
-	_, err := s.Db.Exec(addNewDaemonSQL, id, time.Now())
+// AddNewDaemon Добавление нового демона с его ключом подписи (hex)
+func (s *Storage) AddNewDaemon(id, key string) error {
+	addNewDaemonSQL := `INSERT INTO Daemons (id, status, last_response, signing_key) VALUES (?, 'active', ?, ?)`
+	_, err := s.Db.Exec(addNewDaemonSQL, id, dbTime(time.Now()), key)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// UpdateDaemonStatus Обновление статуса демона
-func (s *Storage) UpdateDaemonStatus(id, newStatus string) error {
-	updateDaemonSQL := `UPDATE Daemons SET status=? WHERE id=?`
+// GetDaemonKey Ключ подписи демона (hex) и его статус.
+// У демонов, зарегистрированных до появления хранимых ключей, ключ пустой.
+func (s *Storage) GetDaemonKey(id string) (string, string, bool) {
+	getDaemonKeySQL := `SELECT COALESCE(signing_key, ''), status FROM Daemons WHERE id=?`
+	var key, status string
+	err := s.Db.QueryRow(getDaemonKeySQL, id).Scan(&key, &status)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("ERROR: ", err.Error())
+		}
+		return "", "", false
+	}
+	return key, status, true
+}
+
+// GetDaemon Получение демона по его ID
+func (s *Storage) GetDaemon(id string) (structures.Daemon, bool) {
+	getDaemonSQL := `SELECT id, status, last_response FROM Daemons WHERE id=?`
+	var d structures.Daemon
+	err := s.Db.QueryRow(getDaemonSQL, id).Scan(&d.Id, &d.Status, &d.LastResponse)
+	if err != nil {
+		log.Println("ERROR: ", err.Error())
+		return structures.Daemon{}, false
+	}
+	return d, true
+}
+
+// GetAllDaemons Получение всех демонов
+func (s *Storage) GetAllDaemons() ([]structures.Daemon, error) {
+	getDaemonsSQL := `SELECT id, status, last_response FROM Daemons`
+	rows, err := s.Db.Query(getDaemonsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := []structures.Daemon{}
+	for rows.Next() {
+		var d structures.Daemon
+		if err := rows.Scan(&d.Id, &d.Status, &d.LastResponse); err != nil {
+			return nil, err
+		}
+		ans = append(ans, d)
+	}
+	return ans, rows.Err()
+}
+
+// RevokeDaemon Отзыв учетных данных демона, его сообщения больше не принимаются
+func (s *Storage) RevokeDaemon(id string) (bool, error) {
+	revokeDaemonSQL := `UPDATE Daemons SET status='revoked' WHERE id=?`
+	res, err := s.Db.Exec(revokeDaemonSQL, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UpdateDaemonStatus Обновление статуса демона (отозванный демон не меняется).
+// Возвращает true, если статус действительно поменялся.
+func (s *Storage) UpdateDaemonStatus(id, newStatus string) (bool, error) {
+	updateDaemonSQL := `UPDATE Daemons SET status=? WHERE id=? AND status != 'revoked' AND status != ?`
 	q, err := s.Db.Prepare(updateDaemonSQL)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer q.Close()
-	_, err = q.Exec(newStatus, id)
+	res, err := q.Exec(newStatus, id, newStatus)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	n, err := res.RowsAffected()
+	return n == 1, err
 }
 
 // UpdateDaemonLastResponse Обновление времени последнего ответа демона
@@ -144,31 +680,172 @@ func (s *Storage) UpdateDaemonLastResponse(id string) error {
 		return err
 	}
 	defer q.Close()
-	_, err = q.Exec(time.Now(), id)
+	_, err = q.Exec(dbTime(time.Now()), id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// SaveResult Сохранение результата выражения по его ID, изменение статуса выражения
-func (s *Storage) SaveResult(id string, v float32) error {
-	saveResultSQL := `UPDATE Expressions SET result=?, status='done' WHERE id=?`
+// SaveResult Сохранение результата выражения по его ID, изменение статуса выражения.
+// Бесконечности и NaN не сохраняются. false - выражение уже не активно, результат не сохранен.
+func (s *Storage) SaveResult(id string, v float32) (bool, error) {
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return false, fmt.Errorf("refusing to save non-finite result %v of %s", v, id)
+	}
+	saveResultSQL := `UPDATE Expressions SET result=?, status='done' WHERE id=? AND status='active'`
 	q, err := s.Db.Prepare(saveResultSQL)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer q.Close()
-	_, err = q.Exec(v, id)
+	res, err := q.Exec(v, id)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// GetStaleExpressions Получение незавершенных выражений, добавленных раньше before
+func (s *Storage) GetStaleExpressions(before time.Time) ([]structures.Expression, error) {
+	getStaleSQL := `SELECT id, expression FROM Expressions
+		WHERE status='active' AND (created_at IS NULL OR created_at < ?)`
+	rows, err := s.Db.Query(getStaleSQL, dbTime(before))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ans []structures.Expression
+	for rows.Next() {
+		exp := structures.Expression{Status: "active"}
+		if err := rows.Scan(&exp.Id, &exp.Exp); err != nil {
+			return nil, err
+		}
+		ans = append(ans, exp)
+	}
+	return ans, rows.Err()
+}
+
+// StartAttempt Новая попытка выражения: счетчик попыток растет, а аренды нет,
+// пока демон не возьмет одну из его операций (ExtendLease)
+func (s *Storage) StartAttempt(id string, maxAttempts int) error {
+	startAttemptSQL := `UPDATE Expressions SET deadline=NULL, attempts=attempts+1, max_attempts=?
+		WHERE id=? AND status='active'`
+	_, err := s.Db.Exec(startAttemptSQL, maxAttempts, id)
+	return err
+}
+
+// ExtendLease Продление аренды выражения хотя бы до deadline: демон взял его операцию
+func (s *Storage) ExtendLease(id string, deadline time.Time) error {
+	extendLeaseSQL := `UPDATE Expressions SET deadline=?
+		WHERE id=? AND status='active' AND (deadline IS NULL OR deadline < ?)`
+	_, err := s.Db.Exec(extendLeaseSQL, dbTime(deadline), id, dbTime(deadline))
+	return err
+}
+
+// ReleaseLease Снятие аренды, если ни одна операция выражения не в работе у демона:
+// операции, ждущие в очереди, сроком не ограничены
+func (s *Storage) ReleaseLease(id string) error {
+	releaseLeaseSQL := `UPDATE Expressions SET deadline=NULL WHERE id=? AND NOT EXISTS (
+		SELECT 1 FROM Operations WHERE expression_id=? AND status='queued' AND COALESCE(daemon_id, '') != '')`
+	_, err := s.Db.Exec(releaseLeaseSQL, id, id)
+	return err
+}
+
+// GetExpiredExpressions Получение незавершенных выражений с истекшей арендой
+func (s *Storage) GetExpiredExpressions(now time.Time) ([]structures.Expression, error) {
+	getExpiredSQL := `SELECT id, expression, attempts, max_attempts FROM Expressions
+		WHERE status='active' AND deadline IS NOT NULL AND deadline < ?`
+	rows, err := s.Db.Query(getExpiredSQL, dbTime(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ans []structures.Expression
+	for rows.Next() {
+		exp := structures.Expression{Status: "active"}
+		if err := rows.Scan(&exp.Id, &exp.Exp, &exp.Attempts, &exp.MaxAttempts); err != nil {
+			return nil, err
+		}
+		ans = append(ans, exp)
+	}
+	return ans, rows.Err()
+}
+
+// CancelExpression Отмена незавершенного выражения: незавершенные операции тоже отменяются.
+// Возвращает false, если выражение уже не активно.
+func (s *Storage) CancelExpression(id string) (bool, error) {
+	cancelExpressionSQL := `UPDATE Expressions SET status='cancelled', deadline=NULL WHERE id=? AND status='active'`
+	cancelOperationsSQL := `UPDATE Operations SET status='cancelled' WHERE expression_id=? AND status!='done'`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(cancelExpressionSQL, id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(cancelOperationsSQL, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteExpression Удаление выражения вместе с его операциями и callback'ом
+func (s *Storage) DeleteExpression(id string) (bool, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"Operations", "Webhooks", "WebhookAttempts"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE expression_id=?`, id); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM Expressions WHERE id=?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, tx.Commit()
+}
+
+// FailExpression Перевод выражения в статус failed с кодом и описанием причины.
+// Незавершенные операции отменяются, как при CancelExpression. false - выражение уже не активно.
+func (s *Storage) FailExpression(id, code, reason string) (bool, error) {
+	failExpressionSQL := `UPDATE Expressions SET status='failed', error_code=?, error=?, deadline=NULL
+		WHERE id=? AND status='active'`
+	cancelOperationsSQL := `UPDATE Operations SET status='cancelled' WHERE expression_id=? AND status!='done'`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(failExpressionSQL, code, reason, id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(cancelOperationsSQL, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
 // GetDaemonsResponses Возвращает мапу Id-LastResponse демонов
 func (s Storage) GetDaemonsResponses() (map[string]time.Time, error) {
-	getDataSQL := `SELECT id, last_response FROM Daemons`
+	getDataSQL := `SELECT id, last_response FROM Daemons WHERE status != 'revoked'`
 	q, err := s.Db.Query(getDataSQL)
 	if err != nil {
 		return nil, err
@@ -186,3 +863,551 @@ func (s Storage) GetDaemonsResponses() (map[string]time.Time, error) {
 	}
 	return ans, nil
 }
+
+// AddOperations Добавление операций выражения одной транзакцией
+func (s *Storage) AddOperations(ops []structures.Operation) error {
+	addOperationSQL := `INSERT INTO Operations
+		(id, expression_id, parent_id, side, operation, left_value, right_value, left_ready, right_ready, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, op := range ops {
+		_, err = tx.Exec(addOperationSQL, op.Id, op.ExpressionId, op.ParentId, op.Side, op.Operation,
+			op.Left, op.Right, op.LeftReady, op.RightReady, op.Status)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetOperationById Получение операции по ее ID
+func (s *Storage) GetOperationById(id string) (structures.Operation, bool) {
+	getOperationSQL := `SELECT ` + operationColumns + ` FROM Operations WHERE id=?`
+	op, err := scanOperation(s.Db.QueryRow(getOperationSQL, id))
+	if err != nil {
+		log.Println("ERROR: ", err.Error())
+		return structures.Operation{}, false
+	}
+	return op, true
+}
+
+// GetOperationsByExpression Получение всех операций выражения
+func (s *Storage) GetOperationsByExpression(expressionId string) ([]structures.Operation, error) {
+	getOperationsSQL := `SELECT ` + operationColumns + ` FROM Operations WHERE expression_id=?`
+	rows, err := s.Db.Query(getOperationsSQL, expressionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ops []structures.Operation
+	for rows.Next() {
+		op, err := scanOperation(rows)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+const operationColumns = `id, expression_id, parent_id, side, operation, left_value, right_value,
+	left_ready, right_ready, status, result, daemon_id`
+
+// scanOperation Чтение операции из строки результата, колонки как в operationColumns
+func scanOperation(row interface{ Scan(...any) error }) (structures.Operation, error) {
+	var op structures.Operation
+	err := row.Scan(&op.Id, &op.ExpressionId, &op.ParentId, &op.Side, &op.Operation, &op.Left, &op.Right,
+		&op.LeftReady, &op.RightReady, &op.Status, &op.Result, &op.DaemonId)
+	return op, err
+}
+
+// ClaimOperation Перевод операции из ожидания в очередь.
+// Возвращает false, если операция уже была отправлена или ее выражение уже не активно.
+func (s *Storage) ClaimOperation(id string) (bool, error) {
+	claimOperationSQL := `UPDATE Operations SET status='queued' WHERE id=? AND status='waiting'
+		AND EXISTS (SELECT 1 FROM Expressions WHERE id=Operations.expression_id AND status='active')`
+	res, err := s.Db.Exec(claimOperationSQL, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UnclaimOperation Возврат операции, которую не удалось отправить в очередь, в ожидание отправки
+func (s *Storage) UnclaimOperation(id string) error {
+	unclaimOperationSQL := `UPDATE Operations SET status='waiting', daemon_id='', picked_at=NULL
+		WHERE id=? AND status='queued'`
+	_, err := s.Db.Exec(unclaimOperationSQL, id)
+	return err
+}
+
+// SaveOperationResult Сохранение результата операции и подстановка его в операнд родителя.
+// Возвращает завершенную операцию. Бесконечности и NaN не сохраняются.
+// Для уже завершенной операции возвращает ErrOperationDone, для удаленной - ErrOperationNotFound,
+// для отмененной или операции неактивного выражения - ErrOperationCancelled.
+func (s *Storage) SaveOperationResult(id string, v float64) (structures.Operation, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return structures.Operation{}, fmt.Errorf("refusing to save non-finite result %v of %s", v, id)
+	}
+	saveResultSQL := `UPDATE Operations SET result=?, status='done' WHERE id=?`
+	updateLeftSQL := `UPDATE Operations SET left_value=?, left_ready=TRUE WHERE id=?`
+	updateRightSQL := `UPDATE Operations SET right_value=?, right_ready=TRUE WHERE id=?`
+	getOperationSQL := `SELECT o.id, o.expression_id, o.parent_id, o.side, o.status, COALESCE(e.status, '')
+		FROM Operations o LEFT JOIN Expressions e ON e.id=o.expression_id WHERE o.id=?`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return structures.Operation{}, err
+	}
+	defer tx.Rollback()
+	var op structures.Operation
+	var expressionStatus string
+	err = tx.QueryRow(getOperationSQL, id).Scan(&op.Id, &op.ExpressionId, &op.ParentId, &op.Side, &op.Status, &expressionStatus)
+	if errors.Is(err, sql.ErrNoRows) {
+		return structures.Operation{}, ErrOperationNotFound
+	}
+	if err != nil {
+		return structures.Operation{}, err
+	}
+	if op.Status == "done" {
+		return op, ErrOperationDone
+	}
+	if op.Status == "cancelled" || expressionStatus != "active" {
+		return op, ErrOperationCancelled
+	}
+	if _, err = tx.Exec(saveResultSQL, v, id); err != nil {
+		return structures.Operation{}, err
+	}
+	if op.ParentId != "" {
+		updateParentSQL := updateLeftSQL
+		if op.Side == "right" {
+			updateParentSQL = updateRightSQL
+		}
+		if _, err = tx.Exec(updateParentSQL, v, op.ParentId); err != nil {
+			return structures.Operation{}, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return structures.Operation{}, err
+	}
+	op.Status = "done"
+	op.Result = v
+	return op, nil
+}
+
+// AssignOperation Запись о том, какой демон и когда взял операцию в работу.
+// false - операция уже не в очереди (посчитана или отменена).
+func (s *Storage) AssignOperation(id, daemonId string) (bool, error) {
+	assignOperationSQL := `UPDATE Operations SET daemon_id=?, picked_at=? WHERE id=? AND status='queued'`
+	res, err := s.Db.Exec(assignOperationSQL, daemonId, dbTime(time.Now()), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReleaseOperation Возврат взятой демоном операции в очередь без демона
+func (s *Storage) ReleaseOperation(id string) error {
+	releaseOperationSQL := `UPDATE Operations SET daemon_id='', picked_at=NULL WHERE id=? AND status='queued'`
+	_, err := s.Db.Exec(releaseOperationSQL, id)
+	return err
+}
+
+// ReassignOperations Снятие незавершенных операций с демона с записью в журнал переназначений.
+// Возвращает снятые операции, их нужно заново отправить в очередь.
+func (s *Storage) ReassignOperations(daemonId string) ([]structures.Operation, error) {
+	getOperationsSQL := `SELECT id, expression_id, operation, left_value, right_value FROM Operations
+		WHERE daemon_id=? AND status='queued'`
+	logReassignmentSQL := `INSERT INTO Reassignments (operation_id, expression_id, from_daemon, reassigned_at)
+		VALUES (?, ?, ?, ?)`
+	releaseOperationSQL := `UPDATE Operations SET daemon_id='', picked_at=NULL WHERE id=?`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(getOperationsSQL, daemonId)
+	if err != nil {
+		return nil, err
+	}
+	var ops []structures.Operation
+	for rows.Next() {
+		op := structures.Operation{Status: "queued", LeftReady: true, RightReady: true}
+		if err := rows.Scan(&op.Id, &op.ExpressionId, &op.Operation, &op.Left, &op.Right); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	now := dbTime(time.Now())
+	for _, op := range ops {
+		if _, err := tx.Exec(logReassignmentSQL, op.Id, op.ExpressionId, daemonId, now); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(releaseOperationSQL, op.Id); err != nil {
+			return nil, err
+		}
+	}
+	return ops, tx.Commit()
+}
+
+// AddUser Добавление пользователя, для занятого логина возвращает ErrUserExists
+func (s *Storage) AddUser(id, login, passwordHash string) error {
+	addUserSQL := `INSERT INTO Users (id, login, password_hash, created_at) VALUES (?, ?, ?, ?)`
+	_, err := s.Db.Exec(addUserSQL, id, login, passwordHash, dbTime(time.Now()))
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// GetUserByLogin Получение пользователя по логину
+func (s *Storage) GetUserByLogin(login string) (structures.User, bool) {
+	getUserSQL := `SELECT ` + userColumns + ` FROM Users WHERE login=?`
+	u, err := scanUser(s.Db.QueryRow(getUserSQL, login))
+	if err != nil {
+		log.Println("ERROR: ", err.Error())
+		return structures.User{}, false
+	}
+	return u, true
+}
+
+// GetUserById Получение пользователя по ID
+func (s *Storage) GetUserById(id string) (structures.User, bool) {
+	getUserSQL := `SELECT ` + userColumns + ` FROM Users WHERE id=?`
+	u, err := scanUser(s.Db.QueryRow(getUserSQL, id))
+	if err != nil {
+		log.Println("ERROR: ", err.Error())
+		return structures.User{}, false
+	}
+	return u, true
+}
+
+// GetAllUsers Получение всех пользователей
+func (s *Storage) GetAllUsers() ([]structures.User, error) {
+	getUsersSQL := `SELECT ` + userColumns + ` FROM Users ORDER BY created_at`
+	rows, err := s.Db.Query(getUsersSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := []structures.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, u)
+	}
+	return ans, rows.Err()
+}
+
+// SetUserDisabled Блокировка или разблокировка пользователя
+func (s *Storage) SetUserDisabled(id string, disabled bool) (bool, error) {
+	setDisabledSQL := `UPDATE Users SET disabled=? WHERE id=?`
+	res, err := s.Db.Exec(setDisabledSQL, disabled, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SetUserRole Назначение роли пользователю по логину
+func (s *Storage) SetUserRole(login, role string) (bool, error) {
+	setRoleSQL := `UPDATE Users SET role=? WHERE login=?`
+	res, err := s.Db.Exec(setRoleSQL, role, login)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+const userColumns = `id, login, password_hash, role, disabled, created_at`
+
+// scanUser Чтение пользователя из строки результата, колонки как в userColumns
+func scanUser(row interface{ Scan(...any) error }) (structures.User, error) {
+	var u structures.User
+	err := row.Scan(&u.Id, &u.Login, &u.PasswordHash, &u.Role, &u.Disabled, &u.CreatedAt)
+	return u, err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+// AddApiKey Добавление API ключа, хранится только хеш
+func (s *Storage) AddApiKey(k structures.ApiKey) error {
+	addApiKeySQL := `INSERT INTO ApiKeys (id, user_id, name, prefix, key_hash, scope, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.Db.Exec(addApiKeySQL, k.Id, k.UserId, k.Name, k.Prefix, k.Hash, k.Scope, dbTime(k.CreatedAt))
+	return err
+}
+
+// GetApiKeysByUser Получение всех API ключей пользователя, включая отозванные
+func (s *Storage) GetApiKeysByUser(userId string) ([]structures.ApiKey, error) {
+	getApiKeysSQL := `SELECT ` + apiKeyColumns + ` FROM ApiKeys WHERE user_id=? ORDER BY created_at`
+	rows, err := s.Db.Query(getApiKeysSQL, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ans := []structures.ApiKey{}
+	for rows.Next() {
+		k, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, k)
+	}
+	return ans, rows.Err()
+}
+
+// GetApiKeyByHash Получение действующего API ключа по хешу
+func (s *Storage) GetApiKeyByHash(hash string) (structures.ApiKey, bool) {
+	getApiKeySQL := `SELECT ` + apiKeyColumns + ` FROM ApiKeys WHERE key_hash=? AND revoked_at IS NULL`
+	k, err := scanApiKey(s.Db.QueryRow(getApiKeySQL, hash))
+	if err != nil {
+		return structures.ApiKey{}, false
+	}
+	return k, true
+}
+
+// TouchApiKey Запись времени последнего использования API ключа
+func (s *Storage) TouchApiKey(id string) error {
+	touchApiKeySQL := `UPDATE ApiKeys SET last_used_at=? WHERE id=?`
+	_, err := s.Db.Exec(touchApiKeySQL, dbTime(time.Now()), id)
+	return err
+}
+
+// RevokeApiKey Отзыв API ключа пользователя, false если такого действующего ключа нет
+func (s *Storage) RevokeApiKey(id, userId string) (bool, error) {
+	revokeApiKeySQL := `UPDATE ApiKeys SET revoked_at=? WHERE id=? AND user_id=? AND revoked_at IS NULL`
+	res, err := s.Db.Exec(revokeApiKeySQL, dbTime(time.Now()), id, userId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scope, created_at, last_used_at, revoked_at`
+
+// scanApiKey Чтение API ключа из строки результата, колонки как в apiKeyColumns
+func scanApiKey(row interface{ Scan(...any) error }) (structures.ApiKey, error) {
+	var k structures.ApiKey
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&k.Id, &k.UserId, &k.Name, &k.Prefix, &k.Hash, &k.Scope, &k.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return structures.ApiKey{}, err
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		k.RevokedAt = &revoked.Time
+	}
+	return k, nil
+}
+
+// Quota Дневная квота пользователя, из которой списываются операции добавляемых выражений
+type Quota struct {
+	UserId string
+	Day    string
+	Limit  int
+}
+
+// QuotaError Квоты не хватает на операции добавляемых выражений: ничего не добавлено и не списано
+type QuotaError struct {
+	Used  int
+	Limit int
+	Ops   int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("daily quota exceeded: %d of %d operations used, %d more needed", e.Used, e.Limit, e.Ops)
+}
+
+// consumeQuota Списание ops операций из квоты в транзакции tx, если их не хватает - *QuotaError.
+// Выражения без операций квоту не тратят.
+func consumeQuota(tx *sql.Tx, quota Quota, ops int) error {
+	if ops == 0 {
+		return nil
+	}
+	consumeQuotaSQL := `INSERT INTO Usage (user_id, day, operations) SELECT ?, ?, ? WHERE ? <= ?
+		ON CONFLICT (user_id, day) DO UPDATE SET operations=operations+excluded.operations
+		WHERE operations+excluded.operations <= ?
+		RETURNING operations`
+	getUsageSQL := `SELECT operations FROM Usage WHERE user_id=? AND day=?`
+	var used int
+	err := tx.QueryRow(consumeQuotaSQL, quota.UserId, quota.Day, ops, ops, quota.Limit, quota.Limit).Scan(&used)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	err = tx.QueryRow(getUsageSQL, quota.UserId, quota.Day).Scan(&used)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return &QuotaError{Used: used, Limit: quota.Limit, Ops: ops}
+}
+
+// GetUsage Количество операций, использованных пользователем за день
+func (s *Storage) GetUsage(userId, day string) (int, error) {
+	getUsageSQL := `SELECT operations FROM Usage WHERE user_id=? AND day=?`
+	var used int
+	err := s.Db.QueryRow(getUsageSQL, userId, day).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return used, err
+}
+
+// AddEvent Сохранение события, возвращает его с номером. Владелец берется у выражения,
+// у событий без выражения (демоны) владельца нет.
+func (s *Storage) AddEvent(e structures.Event) (structures.Event, error) {
+	addEventSQL := `INSERT INTO Events
+		(type, user_id, expression_id, operation_id, daemon_id, status, result, error_code, error, created_at)
+		VALUES (?, COALESCE((SELECT user_id FROM Expressions WHERE id=?), ''), ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, user_id`
+	e.CreatedAt = time.Now()
+	err := s.Db.QueryRow(addEventSQL, e.Type, e.ExpressionId, e.ExpressionId, e.OperationId, e.DaemonId,
+		e.Status, e.Result, e.ErrorCode, e.Error, dbTime(e.CreatedAt)).Scan(&e.Id, &e.UserId)
+	return e, err
+}
+
+// GetEvents События пользователя с номером больше afterId по порядку, не больше limit.
+// События без владельца (демоны) видны всем.
+func (s *Storage) GetEvents(userId string, afterId int64, limit int) ([]structures.Event, error) {
+	getEventsSQL := `SELECT id, type, user_id, expression_id, operation_id, daemon_id, status, result,
+		error_code, error, created_at FROM Events
+		WHERE id > ? AND (user_id = ? OR user_id = '') ORDER BY id LIMIT ?`
+	rows, err := s.Db.Query(getEventsSQL, afterId, userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ans []structures.Event
+	for rows.Next() {
+		var e structures.Event
+		err := rows.Scan(&e.Id, &e.Type, &e.UserId, &e.ExpressionId, &e.OperationId, &e.DaemonId, &e.Status,
+			&e.Result, &e.ErrorCode, &e.Error, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, e)
+	}
+	return ans, rows.Err()
+}
+
+// PruneEvents Удаление событий старше before
+func (s *Storage) PruneEvents(before time.Time) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM Events WHERE created_at < ?`, dbTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetDueWebhooks Недоставленные callback'и завершенных выражений, время попытки которых пришло
+func (s *Storage) GetDueWebhooks(now time.Time, limit int) ([]structures.Webhook, error) {
+	getDueSQL := `SELECT w.expression_id, w.url, w.secret, w.state, w.attempts FROM Webhooks w
+		JOIN Expressions e ON e.id = w.expression_id
+		WHERE w.state='pending' AND e.status IN ('done', 'failed', 'cancelled')
+		AND (w.next_attempt_at IS NULL OR w.next_attempt_at <= ?)
+		ORDER BY w.next_attempt_at LIMIT ?`
+	rows, err := s.Db.Query(getDueSQL, dbTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ans []structures.Webhook
+	for rows.Next() {
+		var w structures.Webhook
+		if err := rows.Scan(&w.ExpressionId, &w.URL, &w.Secret, &w.State, &w.Attempts); err != nil {
+			return nil, err
+		}
+		ans = append(ans, w)
+	}
+	return ans, rows.Err()
+}
+
+// SaveWebhookAttempt Запись попытки доставки и нового состояния callback'а:
+// pending со временем следующей попытки next, delivered или failed (next пустой)
+func (s *Storage) SaveWebhookAttempt(a structures.WebhookAttempt, state string, next time.Time) error {
+	addAttemptSQL := `INSERT INTO WebhookAttempts (expression_id, attempt, status_code, error, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	updateWebhookSQL := `UPDATE Webhooks SET state=?, attempts=?, next_attempt_at=?,
+		delivered_at=CASE WHEN ?='delivered' THEN ? ELSE delivered_at END WHERE expression_id=?`
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(addAttemptSQL, a.ExpressionId, a.Attempt, a.StatusCode, a.Error, a.Duration.Milliseconds(), dbTime(a.CreatedAt))
+	if err != nil {
+		return err
+	}
+	var nextAt any
+	if !next.IsZero() {
+		nextAt = dbTime(next)
+	}
+	_, err = tx.Exec(updateWebhookSQL, state, a.Attempt, nextAt, state, dbTime(a.CreatedAt), a.ExpressionId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetWebhook Получение callback'а выражения
+func (s *Storage) GetWebhook(expressionId string) (structures.Webhook, bool) {
+	getWebhookSQL := `SELECT expression_id, url, state, attempts, next_attempt_at, delivered_at
+		FROM Webhooks WHERE expression_id=?`
+	var w structures.Webhook
+	var next, delivered sql.NullTime
+	err := s.Db.QueryRow(getWebhookSQL, expressionId).Scan(&w.ExpressionId, &w.URL, &w.State, &w.Attempts, &next, &delivered)
+	if err != nil {
+		return structures.Webhook{}, false
+	}
+	w.NextAttemptAt, w.DeliveredAt = next.Time, delivered.Time
+	return w, true
+}
+
+// GetWebhookAttempts Попытки доставки callback'а выражения по порядку
+func (s *Storage) GetWebhookAttempts(expressionId string) ([]structures.WebhookAttempt, error) {
+	getAttemptsSQL := `SELECT expression_id, attempt, status_code, error, duration_ms, created_at
+		FROM WebhookAttempts WHERE expression_id=? ORDER BY id`
+	rows, err := s.Db.Query(getAttemptsSQL, expressionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ans []structures.WebhookAttempt
+	for rows.Next() {
+		var a structures.WebhookAttempt
+		var ms int64
+		if err := rows.Scan(&a.ExpressionId, &a.Attempt, &a.StatusCode, &a.Error, &ms, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.Duration = time.Duration(ms) * time.Millisecond
+		ans = append(ans, a)
+	}
+	return ans, rows.Err()
+}
@@ -0,0 +1,332 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+)
+
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+	s, err := NewStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Db.Close() })
+	return s
+}
+
+func TestLeaseExpiresWithinSecond(t *testing.T) {
+	s := testStorage(t)
+	if _, err := s.AddExpression(NewExpression{Id: "e1", Exp: "1+2", UserId: "u1"}, Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	// Без фиксированной ширины "...:05.1" сравнивалось бы как более позднее, чем "...:05.123"
+	deadline := time.Date(2024, 1, 2, 3, 4, 5, 100*int(time.Millisecond), time.UTC)
+	if err := s.ExtendLease("e1", deadline); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		now     time.Time
+		expired bool
+	}{
+		{"before", deadline.Add(-time.Millisecond), false},
+		{"same second later", deadline.Add(23 * time.Millisecond), true},
+		{"other zone", deadline.Add(time.Millisecond).In(time.FixedZone("MSK", 3*60*60)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exps, err := s.GetExpiredExpressions(tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(exps) == 1; got != tt.expired {
+				t.Errorf("expired = %v, want %v", got, tt.expired)
+			}
+		})
+	}
+}
+
+func TestMigrateTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Так время записывал драйвер до перехода на timeLayout
+	_, err = s.Db.Exec(`INSERT INTO Expressions (id, expression, status, created_at) VALUES
+		('e1', '1+2', 'active', '2024-01-02 03:04:05.1+03:00'),
+		('e2', '1+2', 'active', '2024-01-02 00:04:05+00:00')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Db.Close()
+	s, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Db.Close()
+	var first string
+	if err := s.Db.Get(&first, `SELECT created_at || '' FROM Expressions ORDER BY created_at LIMIT 1`); err != nil {
+		t.Fatal(err)
+	}
+	if first != "2024-01-02 00:04:05.000+00:00" {
+		t.Errorf("first created_at = %q", first)
+	}
+	stale, err := s.GetStaleExpressions(time.Date(2024, 1, 2, 0, 4, 5, 50*int(time.Millisecond), time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Id != "e2" {
+		t.Errorf("stale = %+v", stale)
+	}
+}
+
+// testExpression Выражение пользователя u1 с ops операциями
+func testExpression(id string, ops int) NewExpression {
+	exp := NewExpression{Id: id, Exp: id, UserId: "u1", ExpHash: id}
+	for i := 0; i < ops; i++ {
+		exp.Operations = append(exp.Operations, structures.Operation{
+			Id: fmt.Sprintf("%s-%d", id, i), ExpressionId: id, Operation: "+", Status: "waiting",
+		})
+	}
+	return exp
+}
+
+func checkUsage(t *testing.T, s *Storage, userId, day string, want int) {
+	t.Helper()
+	used, err := s.GetUsage(userId, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != want {
+		t.Errorf("usage of %s on %s = %d, want %d", userId, day, used, want)
+	}
+}
+
+func checkQuotaError(t *testing.T, err error, want *QuotaError) {
+	t.Helper()
+	var quotaErr *QuotaError
+	if want == nil {
+		if err != nil {
+			t.Fatalf("error = %v", err)
+		}
+		return
+	}
+	if !errors.As(err, &quotaErr) || *quotaErr != *want {
+		t.Fatalf("error = %v, want %v", err, want)
+	}
+}
+
+func TestConsumeQuota(t *testing.T) {
+	s := testStorage(t)
+	steps := []struct {
+		name  string
+		quota Quota
+		ops   int
+		err   *QuotaError
+		used  int
+	}{
+		{"first", Quota{"u1", "2024-01-01", 10}, 4, nil, 4},
+		{"up to the limit", Quota{"u1", "2024-01-01", 10}, 6, nil, 10},
+		{"over the limit", Quota{"u1", "2024-01-01", 10}, 1, &QuotaError{Used: 10, Limit: 10, Ops: 1}, 10},
+		{"nothing", Quota{"u1", "2024-01-01", 10}, 0, nil, 10},
+		{"next day", Quota{"u1", "2024-01-02", 10}, 10, nil, 10},
+		{"new day over the limit", Quota{"u1", "2024-01-03", 10}, 11, &QuotaError{Used: 0, Limit: 10, Ops: 11}, 0},
+		{"other user", Quota{"u2", "2024-01-01", 10}, 3, nil, 3},
+		{"limit raised", Quota{"u1", "2024-01-01", 12}, 2, nil, 12},
+	}
+	for _, st := range steps {
+		t.Run(st.name, func(t *testing.T) {
+			tx, err := s.Db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			checkQuotaError(t, consumeQuota(tx, st.quota, st.ops), st.err)
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			checkUsage(t, s, st.quota.UserId, st.quota.Day, st.used)
+		})
+	}
+}
+
+func TestAddExpressionQuota(t *testing.T) {
+	s := testStorage(t)
+	quota := Quota{"u1", "2024-01-01", 5}
+	added, err := s.AddExpression(testExpression("e1", 3), quota)
+	if err != nil || !added {
+		t.Fatalf("AddExpression = %v, %v", added, err)
+	}
+	checkUsage(t, s, "u1", "2024-01-01", 3)
+
+	// Повтор не добавляется и не списывается
+	added, err = s.AddExpression(testExpression("e1", 3), quota)
+	if err != nil || added {
+		t.Fatalf("AddExpression of a duplicate = %v, %v", added, err)
+	}
+	checkUsage(t, s, "u1", "2024-01-01", 3)
+
+	// Без квоты не остается ни выражения, ни его операций
+	_, err = s.AddExpression(testExpression("e2", 3), quota)
+	checkQuotaError(t, err, &QuotaError{Used: 3, Limit: 5, Ops: 3})
+	if _, ok := s.GetExpressionById("e2"); ok {
+		t.Error("expression over the quota is stored")
+	}
+	var ops int
+	if err := s.Db.Get(&ops, `SELECT COUNT(*) FROM Operations WHERE expression_id='e2'`); err != nil || ops != 0 {
+		t.Errorf("operations over the quota = %d, %v", ops, err)
+	}
+
+	cached := testExpression("e3", 0)
+	cached.Cached = true
+	if added, err := s.AddExpression(cached, quota); err != nil || !added {
+		t.Fatalf("AddExpression of a cached expression = %v, %v", added, err)
+	}
+	checkUsage(t, s, "u1", "2024-01-01", 3)
+}
+
+func TestAddBatchQuota(t *testing.T) {
+	s := testStorage(t)
+	quota := Quota{"u1", "2024-01-01", 10}
+	if _, err := s.AddExpression(testExpression("e1", 2), quota); err != nil {
+		t.Fatal(err)
+	}
+
+	// Каждое добавленное выражение стоит своих операций, уже добавленное - ничего
+	batch := structures.Batch{Id: "b1", UserId: "u1", Total: 3, CreatedAt: time.Now()}
+	items := []structures.BatchItem{{Position: 0, ExpressionId: "e1"}, {Position: 1, ExpressionId: "e2"}, {Position: 2, ExpressionId: "e3"}}
+	exps := []NewExpression{testExpression("e1", 2), testExpression("e2", 2), testExpression("e3", 1)}
+	added, err := s.AddBatch(batch, items, exps, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || added[0].Id != "e2" || added[1].Id != "e3" {
+		t.Errorf("added = %+v", added)
+	}
+	if !items[0].Duplicate || items[1].Duplicate || items[2].Duplicate {
+		t.Errorf("items = %+v", items)
+	}
+	checkUsage(t, s, "u1", "2024-01-01", 5)
+
+	// Пачка дороже остатка квоты не добавляется целиком
+	batch = structures.Batch{Id: "b2", UserId: "u1", Total: 2, CreatedAt: time.Now()}
+	items = []structures.BatchItem{{Position: 0, ExpressionId: "e4"}, {Position: 1, ExpressionId: "e5"}}
+	exps = []NewExpression{testExpression("e4", 3), testExpression("e5", 3)}
+	_, err = s.AddBatch(batch, items, exps, quota)
+	checkQuotaError(t, err, &QuotaError{Used: 5, Limit: 10, Ops: 6})
+	if _, ok := s.GetBatch("b2"); ok {
+		t.Error("batch over the quota is stored")
+	}
+	if _, ok := s.GetExpressionById("e4"); ok {
+		t.Error("expression of the batch over the quota is stored")
+	}
+	checkUsage(t, s, "u1", "2024-01-01", 5)
+}
+
+func TestListExpressionsCursor(t *testing.T) {
+	s := testStorage(t)
+	// Повторы в каждой колонке сортировки: между равными значениями порядок задает rowid
+	rows := []struct {
+		id, exp, status string
+		result          float32
+	}{
+		{"e1", "2+2", "done", 4},
+		{"e2", "1+1", "done", 2},
+		{"e3", "2+2", "done", 4},
+		{"e4", "3*3", "active", 0},
+		{"e5", "1+1", "done", 2},
+		{"e6", "9-5", "failed", 0},
+		{"e7", "2+2", "active", 0},
+		{"e8", "0.1+0.2", "done", 0.3},
+	}
+	for _, r := range rows {
+		exp := NewExpression{Id: r.id, Exp: r.exp, UserId: "u1", Cached: true, Result: r.result}
+		if _, err := s.AddExpression(exp, Quota{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Db.Exec(`UPDATE Expressions SET status=? WHERE id=?`, r.status, r.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.AddExpression(NewExpression{Id: "other", Exp: "1+1", UserId: "u2", Cached: true}, Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	less := map[string]func(i, j int) bool{
+		"created_at": func(i, j int) bool { return false },
+		"status":     func(i, j int) bool { return rows[i].status < rows[j].status },
+		"expression": func(i, j int) bool { return rows[i].exp < rows[j].exp },
+		"result":     func(i, j int) bool { return rows[i].result < rows[j].result },
+	}
+	for sortBy, lessFn := range less {
+		for _, desc := range []bool{false, true} {
+			// Ожидаемый порядок: по значению, равные по порядку добавления, по убыванию - все наоборот
+			order := []int{0, 1, 2, 3, 4, 5, 6, 7}
+			sort.SliceStable(order, func(a, b int) bool { return lessFn(order[a], order[b]) })
+			var want []string
+			for _, i := range order {
+				want = append(want, rows[i].id)
+			}
+			if desc {
+				slices.Reverse(want)
+			}
+			for _, limit := range []int{1, 2, 3, 8} {
+				t.Run(fmt.Sprintf("%s desc=%v limit=%d", sortBy, desc, limit), func(t *testing.T) {
+					q := ExpressionQuery{UserId: "u1", Sort: sortBy, Desc: desc, Limit: limit}
+					var got []string
+					for pages := 0; ; pages++ {
+						if pages > len(rows) {
+							t.Fatalf("cursor does not advance: %v", got)
+						}
+						page, next, err := s.ListExpressions(q)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if len(page) > limit {
+							t.Fatalf("page of %d, limit %d", len(page), limit)
+						}
+						for _, e := range page {
+							got = append(got, e.Id)
+						}
+						if next == "" {
+							break
+						}
+						q.Cursor = next
+					}
+					if !slices.Equal(got, want) {
+						t.Errorf("ids = %v, want %v", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestListExpressionsInvalidCursor(t *testing.T) {
+	s := testStorage(t)
+	for _, id := range []string{"e1", "e2"} {
+		if _, err := s.AddExpression(NewExpression{Id: id, Exp: id, UserId: "u1", Cached: true}, Quota{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, next, err := s.ListExpressions(ExpressionQuery{Sort: "status", Limit: 1})
+	if err != nil || next == "" {
+		t.Fatalf("ListExpressions = %q, %v", next, err)
+	}
+	for name, cursor := range map[string]string{"other sort": next, "not base64": "!!!", "not json": "bm90IGpzb24"} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := s.ListExpressions(ExpressionQuery{Sort: "result", Limit: 1, Cursor: cursor})
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("error = %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package events
+
+import (
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"log"
+	"sync"
+)
+
+// Типы событий
+const (
+	ExpressionCreated   = "expression.created"
+	ExpressionPickedUp  = "expression.picked_up"
+	ExpressionDone      = "expression.done"
+	ExpressionFailed    = "expression.failed"
+	ExpressionCancelled = "expression.cancelled"
+	DaemonStatus        = "daemon.status"
+)
+
+// bufferSize Сколько событий подписчик может не забрать, прежде чем его отключат
+const bufferSize = 64
+
+// Stream Поток событий: каждое событие сохраняется в таблицу Events (по ней подписчик
+// догоняет пропущенное) и рассылается подписчикам этого процесса
+type Stream struct {
+	storage *data.Storage
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+}
+
+// Subscription Подписка на события одного пользователя и событий демонов (или на все события).
+// Канал C закрывается при отписке или если подписчик не успевает забирать события.
+type Subscription struct {
+	C      chan structures.Event
+	userId string
+	all    bool
+}
+
+// New Создание потока событий поверх хранилища
+func New(storage *data.Storage) *Stream {
+	return &Stream{storage: storage, subs: map[*Subscription]struct{}{}}
+}
+
+// Publish Сохранение события и рассылка подписчикам. Ошибка сохранения только логируется:
+// из-за событий обработка выражений не должна останавливаться. На nil потоке ничего не делает.
+func (s *Stream) Publish(e structures.Event) {
+	if s == nil {
+		return
+	}
+	// Под блокировкой, чтобы подписчики получали события в порядке их номеров
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.storage.AddEvent(e)
+	if err != nil {
+		log.Println("cant save event:", e.Type, e.ExpressionId, e.DaemonId, err.Error())
+		return
+	}
+	for sub := range s.subs {
+		if !sub.all && e.UserId != "" && e.UserId != sub.userId {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			// Медленный подписчик отключается, пропущенное он догонит по Last-Event-ID
+			log.Println("event subscriber is too slow, dropping it:", sub.userId)
+			close(sub.C)
+			delete(s.subs, sub)
+		}
+	}
+}
+
+// Subscribe Подписка на новые события пользователя userId
+func (s *Stream) Subscribe(userId string) *Subscription {
+	return s.add(&Subscription{C: make(chan structures.Event, bufferSize), userId: userId})
+}
+
+// SubscribeAll Подписка на новые события всех пользователей, для обработчиков внутри оркестратора
+func (s *Stream) SubscribeAll() *Subscription {
+	return s.add(&Subscription{C: make(chan structures.Event, bufferSize), all: true})
+}
+
+func (s *Stream) add(sub *Subscription) *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe Отписка, повторная отписка ничего не делает
+func (s *Stream) Unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub]; !ok {
+		return
+	}
+	close(sub.C)
+	delete(s.subs, sub)
+}
+
+// Since События пользователя после события с номером afterId, из хранилища
+func (s *Stream) Since(userId string, afterId int64, limit int) ([]structures.Event, error) {
+	return s.storage.GetEvents(userId, afterId, limit)
+}
@@ -0,0 +1,36 @@
+package grpcapi
+
+import (
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"time"
+)
+
+// NewExpression Выражение в сообщении gRPC: результат только у посчитанных, ошибка только у failed, как в /api/v1
+func NewExpression(exp structures.Expression) *Expression {
+	res := &Expression{
+		Id:         exp.Id,
+		Expression: exp.Exp,
+		Status:     exp.Status,
+		OwnerId:    exp.UserId,
+	}
+	if exp.Status == "done" {
+		res.Result = exp.Result
+	}
+	if exp.Status == "failed" {
+		res.ErrorCode = exp.ErrorCode
+		res.Error = exp.Error
+	}
+	if !exp.CreatedAt.IsZero() {
+		res.CreatedAt = exp.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	return res
+}
+
+// NewAgent Агент в сообщении gRPC
+func NewAgent(d structures.Daemon) *Agent {
+	res := &Agent{Id: d.Id, Status: d.Status}
+	if !d.LastResponse.IsZero() {
+		res.LastResponse = d.LastResponse.UTC().Format(time.RFC3339)
+	}
+	return res
+}
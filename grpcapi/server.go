@@ -0,0 +1,260 @@
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative calc.proto
+
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/j0pl0p/final-task-GO-YL/api"
+	"github.com/j0pl0p/final-task-GO-YL/auth"
+	"github.com/j0pl0p/final-task-GO-YL/service"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// scopes Право, нужное каждому методу gRPC API, как у соответствующих маршрутов /api/v1
+var scopes = map[string]string{
+	Calculator_Submit_FullMethodName:     auth.ScopeSubmit,
+	Calculator_Get_FullMethodName:        auth.ScopeRead,
+	Calculator_List_FullMethodName:       auth.ScopeRead,
+	Calculator_Cancel_FullMethodName:     auth.ScopeSubmit,
+	Calculator_Watch_FullMethodName:      auth.ScopeRead,
+	Calculator_ListAgents_FullMethodName: auth.ScopeRead,
+}
+
+// Server Реализация Calculator поверх того же service.Service, что у HTTP API
+type Server struct {
+	UnimplementedCalculatorServer
+	svc   *service.Service
+	authn *auth.Authenticator
+}
+
+// NewServer gRPC сервер с Calculator и проверкой токенов на каждом вызове
+func NewServer(svc *service.Service, authn *auth.Authenticator) *grpc.Server {
+	s := &Server{svc: svc, authn: authn}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	)
+	RegisterCalculatorServer(server, s)
+	return server
+}
+
+// Аутентификация вызова по метаданным authorization (Bearer токен или API ключ), как у HTTP
+func (s *Server) authenticate(ctx context.Context, method string) (context.Context, error) {
+	scope, ok := scopes[method]
+	if !ok {
+		scope = auth.ScopeSession
+	}
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+	user, err := s.authn.Check(header, scope)
+	if err != nil {
+		return ctx, statusError(err)
+	}
+	return auth.WithUser(ctx, user), nil
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authStream{ServerStream: ss, ctx: ctx})
+}
+
+// authStream Поток с пользователем в контексте
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a authStream) Context() context.Context {
+	return a.ctx
+}
+
+// Ошибка запроса в статус gRPC, код ошибки API уходит в сообщение
+func statusError(err error) error {
+	e := api.AsError(err)
+	code := codes.Internal
+	switch e.Status {
+	case 400, 422:
+		code = codes.InvalidArgument
+	case 401:
+		code = codes.Unauthenticated
+	case 403:
+		code = codes.PermissionDenied
+	case 404:
+		code = codes.NotFound
+	case 409, 410:
+		code = codes.FailedPrecondition
+	case 429:
+		code = codes.ResourceExhausted
+	}
+	return status.Errorf(code, "%s: %s", e.Code, e.Message)
+}
+
+// Submit Добавление выражения, лимиты по IP считаются по адресу gRPC клиента
+func (s *Server) Submit(ctx context.Context, req *SubmitRequest) (*SubmitResponse, error) {
+	user, _ := auth.UserFromContext(ctx)
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	exp, created, err := s.svc.Submit(addr, user, structures.ExpressionDataJSON{
+		Exp:         req.Expression,
+		UseCache:    req.UseCache,
+		CallbackURL: req.CallbackUrl,
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &SubmitResponse{
+		Expression:     NewExpression(exp),
+		Created:        created,
+		CallbackSecret: exp.CallbackSecret,
+	}, nil
+}
+
+// Get Выражение по id, с wait_ms ждет завершения, как ?wait=
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*Expression, error) {
+	user, _ := auth.UserFromContext(ctx)
+	exp, err := s.svc.Get(ctx, user, req.Id, time.Duration(req.WaitMs)*time.Millisecond)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return NewExpression(exp), nil
+}
+
+// List Страница выражений пользователя с теми же фильтрами, что у GET /api/v1/expressions
+func (s *Server) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	user, _ := auth.UserFromContext(ctx)
+	page, err := s.svc.List(user, service.ListRequest{
+		Status: req.Status,
+		From:   req.From,
+		To:     req.To,
+		Q:      req.Q,
+		Sort:   req.Sort,
+		Cursor: req.Cursor,
+		Limit:  int(req.Limit),
+	}, service.DefaultPageSize)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	res := &ListResponse{NextCursor: page.NextCursor}
+	for _, exp := range page.Expressions {
+		res.Expressions = append(res.Expressions, NewExpression(exp))
+	}
+	return res, nil
+}
+
+// Cancel Отмена активного выражения, завершенное выражение не отменить (FAILED_PRECONDITION)
+func (s *Server) Cancel(ctx context.Context, req *CancelRequest) (*Expression, error) {
+	user, _ := auth.UserFromContext(ctx)
+	exp, cancelled, err := s.svc.Cancel(user, req.Id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if !cancelled {
+		return nil, statusError(api.Errorf(409, api.CodeConflict, "expression is already finished"))
+	}
+	return NewExpression(exp), nil
+}
+
+// Watch События выражений пользователя. С ids сначала приходит текущее состояние каждого выражения
+// (событие "expression.state" без номера), и поток заканчивается, когда все они завершатся.
+// С last_event_id сначала отдаются пропущенные события, как с Last-Event-ID у /api/v1/events.
+func (s *Server) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[ExpressionEvent]) error {
+	ctx := stream.Context()
+	user, _ := auth.UserFromContext(ctx)
+	if req.LastEventId < 0 {
+		return statusError(api.Errorf(422, api.CodeValidation, "last_event_id must be an event id"))
+	}
+	if len(req.Ids) > service.MaxSubscriptions {
+		return statusError(api.Errorf(422, api.CodeValidation, "too many ids, at most %d", service.MaxSubscriptions))
+	}
+	// Подписка до чтения состояний, чтобы между ними ничего не потерялось
+	watcher := s.svc.Watch(user, req.LastEventId, req.LastEventId > 0)
+	defer watcher.Close()
+
+	var active map[string]bool
+	if len(req.Ids) > 0 {
+		active = map[string]bool{}
+		for _, id := range req.Ids {
+			exp, err := s.svc.Get(ctx, user, id, 0)
+			if err != nil {
+				e := api.AsError(err)
+				return statusError(&api.Error{Status: e.Status, Code: e.Code, Message: e.Message + ": " + id})
+			}
+			if err := stream.Send(&ExpressionEvent{Type: "expression.state", Expression: NewExpression(exp)}); err != nil {
+				return err
+			}
+			if exp.Status == "active" {
+				active[id] = true
+			}
+		}
+	}
+	for active == nil || len(active) > 0 {
+		e, _, err := watcher.Next(ctx, 0)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, service.ErrStreamDropped) {
+			log.Println("event stream dropped: ", user.Login)
+			return status.Error(codes.Unavailable, "event stream dropped, resume with last_event_id")
+		}
+		if err != nil {
+			return statusError(err)
+		}
+		// События демонов в этот поток не идут
+		if e.ExpressionId == "" || (active != nil && !active[e.ExpressionId]) {
+			continue
+		}
+		err = stream.Send(&ExpressionEvent{
+			Id:          e.Id,
+			Type:        e.Type,
+			Expression:  NewExpression(s.svc.EventExpression(e)),
+			DaemonId:    e.DaemonId,
+			OperationId: e.OperationId,
+		})
+		if err != nil {
+			return err
+		}
+		if active != nil && e.Status != "active" && e.Status != "" {
+			delete(active, e.ExpressionId)
+		}
+	}
+	return nil
+}
+
+// ListAgents Список агентов, как GET /api/v1/agents
+func (s *Server) ListAgents(ctx context.Context, req *ListAgentsRequest) (*ListAgentsResponse, error) {
+	daemons, err := s.svc.Agents()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	res := &ListAgentsResponse{}
+	for _, d := range daemons {
+		res.Agents = append(res.Agents, NewAgent(d))
+	}
+	return res, nil
+}
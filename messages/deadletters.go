@@ -0,0 +1,123 @@
+package messages
+
+import (
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// DeadLetter Сообщение из очереди мертвых сообщений
+type DeadLetter struct {
+	MessageId string    `json:"message_id"`
+	Queue     string    `json:"queue"`
+	Reason    string    `json:"reason"`
+	Retries   int       `json:"retries"`
+	DeadAt    time.Time `json:"dead_at"`
+	Body      string    `json:"body"`
+}
+
+// ListDeadLetters Просмотр до limit сообщений из очереди мертвых сообщений очереди queue без удаления.
+// Сообщения берутся на отдельном канале и возвращаются в очередь при его закрытии.
+func ListDeadLetters(conn *amqp.Connection, queue string, limit int) ([]DeadLetter, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	var ans []DeadLetter
+	for len(ans) < limit {
+		d, ok, err := ch.Get(DeadLetterQueue(queue), false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		ans = append(ans, toDeadLetter(queue, d))
+	}
+	return ans, nil
+}
+
+// GetDeadLetter Поиск мертвого сообщения по его MessageId
+func GetDeadLetter(conn *amqp.Connection, queue, messageId string) (DeadLetter, bool, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return DeadLetter{}, false, err
+	}
+	defer ch.Close()
+	d, ok, err := findDeadLetter(ch, queue, messageId)
+	if err != nil || !ok {
+		return DeadLetter{}, false, err
+	}
+	return toDeadLetter(queue, d), true, nil
+}
+
+// ReplayDeadLetter Возврат мертвого сообщения в исходную очередь со сброшенным счетчиком попыток.
+// Если renew не nil, в очередь уходит тело, которое он вернет (например, переподписанный конверт демона);
+// при его ошибке сообщение остается в очереди мертвых сообщений.
+func ReplayDeadLetter(conn *amqp.Connection, queue, messageId string, renew func([]byte) ([]byte, error)) (bool, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return false, err
+	}
+	d, ok, err := findDeadLetter(ch, queue, messageId)
+	if err != nil || !ok {
+		return false, err
+	}
+	body := d.Body
+	if renew != nil {
+		if body, err = renew(body); err != nil {
+			return false, fmt.Errorf("cant renew message %s: %w", messageId, err)
+		}
+	}
+	err = publishRaw(ch, "", queue, amqp.Publishing{MessageId: d.MessageId, Body: body})
+	if err != nil {
+		return false, fmt.Errorf("cant replay message %s: %w", messageId, err)
+	}
+	return true, d.Ack(false)
+}
+
+// PurgeDeadLetters Удаление всех мертвых сообщений очереди queue, возвращает их количество
+func PurgeDeadLetters(conn *amqp.Connection, queue string) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	return ch.QueuePurge(DeadLetterQueue(queue), false)
+}
+
+// findDeadLetter Перебор очереди мертвых сообщений до нужного. Остальные взятые сообщения
+// остаются неподтвержденными и вернутся в очередь при закрытии канала.
+func findDeadLetter(ch *amqp.Channel, queue, messageId string) (amqp.Delivery, bool, error) {
+	for {
+		d, ok, err := ch.Get(DeadLetterQueue(queue), false)
+		if err != nil || !ok {
+			return amqp.Delivery{}, false, err
+		}
+		if d.MessageId == messageId {
+			return d, true, nil
+		}
+	}
+}
+
+func toDeadLetter(queue string, d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		MessageId: d.MessageId,
+		Queue:     queue,
+		Retries:   RetryCount(d.Headers),
+		Body:      string(d.Body),
+	}
+	// x-death заполняет брокер при отправке сообщения в обменник мертвых сообщений
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			dl.Reason, _ = death["reason"].(string)
+			dl.DeadAt, _ = death["time"].(time.Time)
+		}
+	}
+	return dl
+}
@@ -11,11 +11,14 @@ type Message interface {
 	Imp()
 }
 
-// Task Структура задания
+// Task Структура задания: одна бинарная операция выражения
 type Task struct {
-	Id         string                   `json:"id"`
-	Expression string                   `json:"expression"`
-	Durations  map[string]time.Duration `json:"durations"`
+	Id           string        `json:"id"`
+	ExpressionId string        `json:"expression_id"`
+	Operation    string        `json:"operation"`
+	Left         float64       `json:"left"`
+	Right        float64       `json:"right"`
+	Duration     time.Duration `json:"duration"`
 }
 
 // Beat Структура хертбита
@@ -23,10 +26,31 @@ type Beat struct {
 	Id string `json:"id"`
 }
 
-// Result Структура результата
+// Pickup Структура уведомления о том, что демон взял операцию в работу
+type Pickup struct {
+	Id           string `json:"id"`
+	ExpressionId string `json:"expression_id"`
+	DaemonId     string `json:"daemon_id"`
+}
+
+// Result Структура результата операции
 type Result struct {
-	Id  string  `json:"id"`
-	Res float32 `json:"res"`
+	Id           string  `json:"id"`
+	ExpressionId string  `json:"expression_id"`
+	Res          float64 `json:"res"`
+}
+
+// Error Структура ошибки вычисления операции
+type Error struct {
+	Id           string `json:"id"`
+	ExpressionId string `json:"expression_id"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+}
+
+// Cancel Структура отмены выражения, рассылается всем демонам
+type Cancel struct {
+	ExpressionId string `json:"expression_id"`
 }
 
 // ToBytes Конвертация сообщения в байты
@@ -46,3 +70,6 @@ func FromBytes[T Message](b []byte) (T, error) {
 func (t Task) Imp()   {}
 func (r Result) Imp() {}
 func (b Beat) Imp()   {}
+func (e Error) Imp()  {}
+func (p Pickup) Imp() {}
+func (c Cancel) Imp() {}
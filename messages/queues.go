@@ -0,0 +1,174 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Названия очередей
+const (
+	TasksQueue   = "tasksQueue"
+	ResultsQueue = "resQueue"
+	ErrorsQueue  = "errQueue"
+	BeatsQueue   = "beatQueue"
+	PickupsQueue = "pickQueue"
+)
+
+// CancelExchange Fanout обменник отмен: каждый демон получает каждую отмену в свою очередь
+const CancelExchange = "cancels"
+
+// DeadLetterExchange Обменник, в который брокер отправляет отвергнутые сообщения
+const DeadLetterExchange = "dlx"
+
+// RetryHeader Заголовок с числом повторных публикаций сообщения
+const RetryHeader = "x-retry-count"
+
+// MaxRetries Число повторных публикаций, после которого сообщение считается отравленным
+const MaxRetries = 3
+
+// DeadLettered Очереди, у которых есть очередь мертвых сообщений
+var DeadLettered = []string{TasksQueue, ResultsQueue}
+
+// DeadLetterQueue Название очереди мертвых сообщений для очереди queue
+func DeadLetterQueue(queue string) string {
+	return queue + ".dlq"
+}
+
+// IsDeadLettered У очереди есть очередь мертвых сообщений
+func IsDeadLettered(queue string) bool {
+	for _, q := range DeadLettered {
+		if q == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// DeclareQueue Объявление устойчивой очереди, переживающей перезапуск брокера.
+// Для очередей из DeadLettered также объявляются обменник и очередь мертвых сообщений.
+// Оркестратор и демоны должны объявлять очереди одинаково, иначе брокер вернет PRECONDITION_FAILED.
+func DeclareQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	var args amqp.Table
+	if IsDeadLettered(name) {
+		if err := declareDeadLetterQueue(ch, name); err != nil {
+			return amqp.Queue{}, err
+		}
+		args = amqp.Table{
+			"x-dead-letter-exchange":    DeadLetterExchange,
+			"x-dead-letter-routing-key": name,
+		}
+	}
+	return ch.QueueDeclare(
+		name,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		args,  // args
+	)
+}
+
+func declareDeadLetterQueue(ch *amqp.Channel, name string) error {
+	err := ch.ExchangeDeclare(DeadLetterExchange, "direct", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("cant declare dead letter exchange: %w", err)
+	}
+	dlq, err := ch.QueueDeclare(DeadLetterQueue(name), true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("cant declare dead letter queue: %w", err)
+	}
+	if err := ch.QueueBind(dlq.Name, name, DeadLetterExchange, false, nil); err != nil {
+		return fmt.Errorf("cant bind dead letter queue: %w", err)
+	}
+	return nil
+}
+
+// DeclareCancelExchange Объявление обменника отмен
+func DeclareCancelExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(CancelExchange, "fanout", true, false, false, false, nil)
+}
+
+// BindCancels Очередь демона для отмен: эксклюзивная, удаляется вместе с соединением
+func BindCancels(ch *amqp.Channel) (amqp.Queue, error) {
+	if err := DeclareCancelExchange(ch); err != nil {
+		return amqp.Queue{}, fmt.Errorf("cant declare cancel exchange: %w", err)
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("cant declare cancel queue: %w", err)
+	}
+	if err := ch.QueueBind(q.Name, "", CancelExchange, false, nil); err != nil {
+		return amqp.Queue{}, fmt.Errorf("cant bind cancel queue: %w", err)
+	}
+	return q, nil
+}
+
+// Broadcast Публикация сообщения в fanout обменник
+func Broadcast[T Message](ch *amqp.Channel, exchange string, message T) error {
+	bytes, err := ToBytes[T](message)
+	if err != nil {
+		return fmt.Errorf("cant turn message into bytes: %w", err)
+	}
+	return publishRaw(ch, exchange, "", amqp.Publishing{Body: bytes})
+}
+
+// Publish Публикация сообщения с сохранением на диск брокера.
+// Если канал переведен в режим подтверждений, ждет подтверждения от брокера.
+func Publish[T Message](ch *amqp.Channel, queue string, message T) error {
+	bytes, err := ToBytes[T](message)
+	if err != nil {
+		return fmt.Errorf("cant turn message into bytes: %w", err)
+	}
+	return publishRaw(ch, "", queue, amqp.Publishing{Body: bytes})
+}
+
+// Retry Повторная публикация сообщения в ту же очередь с увеличенным счетчиком попыток.
+// После maxRetries попыток сообщение отвергается и уходит в очередь мертвых сообщений.
+func Retry(ch *amqp.Channel, d amqp.Delivery, maxRetries int) error {
+	retries := RetryCount(d.Headers)
+	if retries >= maxRetries {
+		return d.Nack(false, false)
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[RetryHeader] = int32(retries + 1)
+	err := publishRaw(ch, "", d.RoutingKey, amqp.Publishing{Headers: headers, MessageId: d.MessageId, Body: d.Body})
+	if err != nil {
+		_ = d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
+
+// RetryCount Число повторных публикаций из заголовков сообщения
+func RetryCount(headers amqp.Table) int {
+	switch v := headers[RetryHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func publishRaw(ch *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	msg.ContentType = "application/json"
+	msg.DeliveryMode = amqp.Persistent
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.NewString()
+	}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(context.Background(), exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	if confirm != nil && !confirm.Wait() {
+		return fmt.Errorf("broker rejected message to %s", exchange+key)
+	}
+	return nil
+}
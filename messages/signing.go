@@ -0,0 +1,178 @@
+package messages
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ошибки проверки подписанных сообщений
+var (
+	// ErrBadSignature Подпись сообщения не совпала
+	ErrBadSignature = errors.New("bad message signature")
+	// ErrStale Сообщение старше допустимого (или из будущего больше, чем на clockSkew)
+	ErrStale = errors.New("stale message")
+	// ErrReplayed Сообщение с таким одноразовым номером уже принято
+	ErrReplayed = errors.New("replayed message")
+)
+
+// clockSkew Насколько часы демона могут спешить относительно оркестратора
+const clockSkew = 30 * time.Second
+
+// Signed Конверт с сообщением, подписанным ключом демона.
+// Подпись покрывает тип сообщения, время отправки и одноразовый номер, так что перехваченный
+// конверт нельзя ни выдать за сообщение другого типа, ни отправить повторно.
+type Signed struct {
+	DaemonId  string          `json:"daemon_id"`
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"timestamp"`
+	Nonce     string          `json:"nonce"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+func (s Signed) Imp() {}
+
+// Seal Упаковка сообщения в конверт с HMAC-SHA256 подписью ключом демона
+func Seal(message Message, daemonId string, key []byte) (Signed, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return Signed{}, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return Signed{}, err
+	}
+	s := Signed{
+		DaemonId:  daemonId,
+		Type:      typeOf(message),
+		Timestamp: time.Now().UnixMilli(),
+		Nonce:     hex.EncodeToString(nonce),
+		Payload:   payload,
+	}
+	s.Signature = sign(key, s)
+	return s, nil
+}
+
+// Guard Проверка конвертов: ключ демона, подпись, свежесть и повторы.
+// Номера принятых сообщений помнятся, пока сообщение не устареет.
+type Guard struct {
+	keyFor func(daemonId string) ([]byte, error)
+	maxAge time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// NewGuard Создание проверки. keyFor возвращает ключ демона или ошибку, если демон неизвестен или отозван;
+// сообщения старше maxAge отвергаются.
+func NewGuard(keyFor func(daemonId string) ([]byte, error), maxAge time.Duration) *Guard {
+	return &Guard{keyFor: keyFor, maxAge: maxAge, seen: map[string]time.Time{}}
+}
+
+// Open Проверка конверта и распаковка сообщения. Номер сообщения не запоминается:
+// после успешной обработки нужно вызвать Accept, иначе повтор той же доставки (Retry, requeue) будет отвергнут.
+func Open[T Message](g *Guard, b []byte) (T, Signed, error) {
+	var message T
+	envelope, err := FromBytes[Signed](b)
+	if err != nil {
+		return message, envelope, err
+	}
+	key, err := g.keyFor(envelope.DaemonId)
+	if err != nil {
+		return message, envelope, err
+	}
+	if !hmac.Equal([]byte(sign(key, envelope)), []byte(envelope.Signature)) {
+		return message, envelope, ErrBadSignature
+	}
+	if envelope.Type != typeOf(message) {
+		return message, envelope, fmt.Errorf("%w: %s instead of %s", ErrBadSignature, envelope.Type, typeOf(message))
+	}
+	sent := time.UnixMilli(envelope.Timestamp)
+	now := time.Now()
+	if now.Sub(sent) > g.maxAge || sent.Sub(now) > clockSkew {
+		return message, envelope, fmt.Errorf("%w: sent at %s", ErrStale, sent.Format(time.RFC3339))
+	}
+	if g.accepted(envelope) {
+		return message, envelope, ErrReplayed
+	}
+	if err := json.Unmarshal(envelope.Payload, &message); err != nil {
+		return message, envelope, fmt.Errorf("cant decode payload: %w", err)
+	}
+	return message, envelope, nil
+}
+
+// Renew Переподпись конверта для возврата мертвого сообщения в очередь: исходная подпись проверяется,
+// а время отправки и одноразовый номер заменяются новыми, иначе сообщение старше maxAge сразу отвергнется снова.
+// Подписывает оркестратор тем же ключом демона, поэтому поддельный или отозванный конверт так не обновить.
+func (g *Guard) Renew(b []byte) ([]byte, error) {
+	envelope, err := FromBytes[Signed](b)
+	if err != nil {
+		return nil, err
+	}
+	key, err := g.keyFor(envelope.DaemonId)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sign(key, envelope)), []byte(envelope.Signature)) {
+		return nil, ErrBadSignature
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope.Timestamp = time.Now().UnixMilli()
+	envelope.Nonce = hex.EncodeToString(nonce)
+	envelope.Signature = sign(key, envelope)
+	return json.Marshal(envelope)
+}
+
+// Accept Запоминание обработанного сообщения: его повторная отправка будет отвергнута
+func (g *Guard) Accept(envelope Signed) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.pruned) > time.Minute {
+		for k, until := range g.seen {
+			if now.After(until) {
+				delete(g.seen, k)
+			}
+		}
+		g.pruned = now
+	}
+	// После maxAge сообщение отвергается как устаревшее, помнить его дольше не нужно
+	g.seen[seenKey(envelope)] = time.UnixMilli(envelope.Timestamp).Add(g.maxAge + clockSkew)
+}
+
+func (g *Guard) accepted(envelope Signed) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.seen[seenKey(envelope)]
+	return ok
+}
+
+func seenKey(envelope Signed) string {
+	return envelope.DaemonId + "." + envelope.Nonce
+}
+
+// typeOf Тип сообщения в конверте: beat, result...
+func typeOf(message Message) string {
+	return fmt.Sprintf("%T", message)
+}
+
+func sign(key []byte, s Signed) string {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range []string{s.DaemonId, s.Type, strconv.FormatInt(s.Timestamp, 10), s.Nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'.'})
+	}
+	mac.Write(s.Payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,153 @@
+package messages
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errUnknownDaemon = errors.New("unknown daemon")
+
+func testGuard(maxAge time.Duration) *Guard {
+	return NewGuard(func(daemonId string) ([]byte, error) {
+		if daemonId != "d1" {
+			return nil, errUnknownDaemon
+		}
+		return []byte("key-d1"), nil
+	}, maxAge)
+}
+
+// sealAt Конверт результата демона d1, отправленный в момент sent
+func sealAt(t *testing.T, sent time.Time) Signed {
+	t.Helper()
+	s, err := Seal(Result{Id: "op", ExpressionId: "exp", Res: 3}, "d1", []byte("key-d1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Timestamp = sent.UnixMilli()
+	s.Signature = sign([]byte("key-d1"), s)
+	return s
+}
+
+func encode(t *testing.T, s Signed) []byte {
+	t.Helper()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		signed func() Signed
+		err    error
+	}{
+		{"valid", func() Signed { return sealAt(t, now) }, nil},
+		{"slightly ahead", func() Signed { return sealAt(t, now.Add(clockSkew/2)) }, nil},
+		{"bad mac", func() Signed {
+			s := sealAt(t, now)
+			s.Payload = json.RawMessage(`{"id":"op","expression_id":"exp","res":4}`)
+			return s
+		}, ErrBadSignature},
+		{"other key", func() Signed {
+			s := sealAt(t, now)
+			s.Signature = sign([]byte("key-d2"), s)
+			return s
+		}, ErrBadSignature},
+		{"unknown daemon", func() Signed {
+			s := sealAt(t, now)
+			s.DaemonId = "d2"
+			return s
+		}, errUnknownDaemon},
+		{"wrong type", func() Signed {
+			s := sealAt(t, now)
+			s.Type = typeOf(Beat{})
+			s.Signature = sign([]byte("key-d1"), s)
+			return s
+		}, ErrBadSignature},
+		{"stale", func() Signed { return sealAt(t, now.Add(-2*time.Minute)) }, ErrStale},
+		{"from the future", func() Signed { return sealAt(t, now.Add(clockSkew+5*time.Second)) }, ErrStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGuard(time.Minute)
+			msg, _, err := Open[Result](g, encode(t, tt.signed()))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Open error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (msg.Id != "op" || msg.Res != 3) {
+				t.Errorf("Open message = %+v", msg)
+			}
+		})
+	}
+}
+
+func TestOpenReplayed(t *testing.T) {
+	g := testGuard(time.Minute)
+	b := encode(t, sealAt(t, time.Now()))
+	_, envelope, err := Open[Result](g, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// До Accept повтор той же доставки проходит: сообщение еще не обработано
+	if _, _, err := Open[Result](g, b); err != nil {
+		t.Fatalf("Open before Accept error = %v", err)
+	}
+	g.Accept(envelope)
+	if _, _, err := Open[Result](g, b); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("Open after Accept error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestAcceptForgetsExpiredNonces(t *testing.T) {
+	g := testGuard(time.Minute)
+	old := sealAt(t, time.Now().Add(-time.Minute-clockSkew-time.Second))
+	g.Accept(old)
+	if !g.accepted(old) {
+		t.Fatal("nonce is not remembered")
+	}
+	// Чистка идет не чаще раза в минуту
+	g.pruned = time.Time{}
+	fresh := sealAt(t, time.Now())
+	g.Accept(fresh)
+	if g.accepted(old) {
+		t.Error("expired nonce is still remembered")
+	}
+	if !g.accepted(fresh) {
+		t.Error("fresh nonce is forgotten")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	g := testGuard(time.Minute)
+	stale := sealAt(t, time.Now().Add(-time.Hour))
+	if _, _, err := Open[Result](g, encode(t, stale)); !errors.Is(err, ErrStale) {
+		t.Fatalf("Open stale error = %v, want %v", err, ErrStale)
+	}
+	b, err := g.Renew(encode(t, stale))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, renewed, err := Open[Result](g, b)
+	if err != nil {
+		t.Fatalf("Open renewed error = %v", err)
+	}
+	if msg.Res != 3 || renewed.Nonce == stale.Nonce {
+		t.Errorf("renewed = %+v, message %+v", renewed, msg)
+	}
+
+	forged := stale
+	forged.Payload = json.RawMessage(`{"id":"op","expression_id":"exp","res":4}`)
+	if _, err := g.Renew(encode(t, forged)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Renew forged error = %v, want %v", err, ErrBadSignature)
+	}
+	foreign := stale
+	foreign.DaemonId = "d2"
+	if _, err := g.Renew(encode(t, foreign)); !errors.Is(err, errUnknownDaemon) {
+		t.Errorf("Renew unknown daemon error = %v, want %v", err, errUnknownDaemon)
+	}
+}
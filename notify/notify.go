@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"sync"
+)
+
+// Hub Оповещения внутри процесса: ожидающие подписываются на ключ (id выражения),
+// Notify будит всех, кто ждет этот ключ. Вместо опроса базы.
+type Hub struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// New Создание пустого хаба
+func New() *Hub {
+	return &Hub{waiters: map[string]map[chan struct{}]struct{}{}}
+}
+
+// Subscribe Подписка на ключ: канал закрывается при следующем Notify этого ключа.
+// Возвращаемая функция снимает подписку, ее надо вызвать, если оповещение больше не нужно.
+func (h *Hub) Subscribe(key string) (<-chan struct{}, func()) {
+	c := make(chan struct{})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.waiters[key] == nil {
+		h.waiters[key] = map[chan struct{}]struct{}{}
+	}
+	h.waiters[key][c] = struct{}{}
+	return c, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.waiters[key][c]; !ok {
+			return
+		}
+		delete(h.waiters[key], c)
+		if len(h.waiters[key]) == 0 {
+			delete(h.waiters, key)
+		}
+	}
+}
+
+// Notify Оповещение всех подписчиков ключа, подписки снимаются. На nil хабе ничего не делает.
+func (h *Hub) Notify(key string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.waiters[key] {
+		close(c)
+	}
+	delete(h.waiters, key)
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter Ограничитель запросов "token bucket" с отдельным ведром на каждый ключ
+type Limiter struct {
+	rate    float64 // токенов в секунду
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New Создание ограничителя: perMinute запросов в минуту с запасом burst.
+// Если perMinute <= 0, ограничитель пропускает все.
+func New(perMinute float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow Попытка взять токен для ключа. Если токенов нет, возвращает через сколько он появится.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN Попытка взять n токенов сразу (например, за каждый элемент пачки): все или ничего.
+// Запрос дороже burst проходит только при полном ведре и уводит его в минус,
+// так что следующие запросы ждут, пока долг не восполнится.
+func (l *Limiter) AllowN(key string, n int) (bool, time.Duration) {
+	if l.rate <= 0 || n <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	if l.calls%1000 == 0 {
+		l.evict(now)
+	}
+	b := l.refill(key, now)
+	need := math.Min(float64(n), l.burst)
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+	wait := time.Duration((need - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Refund Возврат n токенов, взятых запросом, который все-таки не прошел (например, по другому ограничителю)
+func (l *Limiter) Refund(key string, n int) {
+	if l.rate <= 0 || n <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, now)
+	b.tokens = math.Min(l.burst, b.tokens+float64(n))
+}
+
+// refill Ведро ключа с токенами, накопившимися к now
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// evict Удаление ведер, которые уже наполнились: новое ведро для ключа будет таким же
+func (l *Limiter) evict(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// advance Сдвиг последнего пополнения ведра key в прошлое, как будто прошло d
+func advance(l *Limiter, key string, d time.Duration) {
+	if b, ok := l.buckets[key]; ok {
+		b.last = b.last.Add(-d)
+	}
+}
+
+// checkWait Ожидание считается от текущего времени, за время теста ведро успевает чуть пополниться
+func checkWait(t *testing.T, got, want time.Duration) {
+	t.Helper()
+	if got > want || got < want-50*time.Millisecond {
+		t.Errorf("wait = %v, want %v", got, want)
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	// 60 в минуту - токен в секунду, в ведре не больше 5
+	type step struct {
+		elapsed time.Duration
+		n       int
+		ok      bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"burst", []step{
+			{0, 1, true, 0},
+			{0, 4, true, 0},
+			{0, 1, false, time.Second},
+		}},
+		{"all or nothing", []step{
+			{0, 3, true, 0},
+			{0, 3, false, time.Second},
+			{0, 2, true, 0},
+		}},
+		{"refill", []step{
+			{0, 5, true, 0},
+			{1500 * time.Millisecond, 2, false, 500 * time.Millisecond},
+			{500 * time.Millisecond, 2, true, 0},
+		}},
+		{"refill is capped by burst", []step{
+			{0, 5, true, 0},
+			{time.Hour, 5, true, 0},
+			{0, 1, false, time.Second},
+		}},
+		{"more than burst leaves a debt", []step{
+			{0, 8, true, 0},
+			{0, 1, false, 4 * time.Second},
+			{3 * time.Second, 1, false, time.Second},
+			{time.Second, 1, true, 0},
+		}},
+		{"more than burst needs a full bucket", []step{
+			{0, 1, true, 0},
+			{0, 8, false, time.Second},
+		}},
+		{"nothing requested", []step{
+			{0, 5, true, 0},
+			{0, 0, true, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(60, 5)
+			for i, s := range tt.steps {
+				advance(l, "k", s.elapsed)
+				ok, wait := l.AllowN("k", s.n)
+				if ok != s.ok {
+					t.Fatalf("step %d: AllowN(%d) = %v, want %v", i, s.n, ok, s.ok)
+				}
+				checkWait(t, wait, s.wait)
+			}
+		})
+	}
+}
+
+func TestAllowNKeys(t *testing.T) {
+	l := New(60, 2)
+	if ok, _ := l.AllowN("a", 2); !ok {
+		t.Fatal("first request of a is rejected")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("a is over the limit")
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("b shares the bucket of a")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l := New(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, wait := l.AllowN("k", 1000); !ok || wait != 0 {
+			t.Fatalf("disabled limiter rejected request %d", i)
+		}
+	}
+	l.Refund("k", 1000)
+}
+
+func TestRefund(t *testing.T) {
+	tests := []struct {
+		name    string
+		taken   int
+		refund  int
+		allowed int // сколько запросов по одному токену проходит после возврата
+	}{
+		{"partial", 5, 2, 2},
+		{"all", 5, 5, 5},
+		{"capped by burst", 1, 10, 5},
+		{"full bucket", 0, 3, 5},
+		{"debt", 8, 8, 5},
+		{"nothing", 5, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(60, 5)
+			if ok, _ := l.AllowN("k", tt.taken); !ok {
+				t.Fatalf("AllowN(%d) is rejected", tt.taken)
+			}
+			l.Refund("k", tt.refund)
+			allowed := 0
+			for {
+				if ok, _ := l.Allow("k"); !ok {
+					break
+				}
+				allowed++
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed = %d, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestEvict(t *testing.T) {
+	l := New(60, 5)
+	l.AllowN("full", 1)
+	l.AllowN("empty", 5)
+	advance(l, "full", time.Second)
+	l.evict(time.Now())
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("refilled bucket is kept")
+	}
+	if _, ok := l.buckets["empty"]; !ok {
+		t.Error("empty bucket is evicted")
+	}
+}
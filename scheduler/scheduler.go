@@ -0,0 +1,438 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/j0pl0p/final-task-GO-YL/arithmetic"
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/events"
+	"github.com/j0pl0p/final-task-GO-YL/messages"
+	"github.com/j0pl0p/final-task-GO-YL/notify"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"time"
+)
+
+// CodeTimeout Код ошибки выражения, которое не посчиталось за все попытки
+const CodeTimeout = "timeout"
+
+// Scheduler Планировщик: раскладывает выражения на операции, рассылает готовые
+// операции демонам и по мере прихода результатов отправляет зависящие от них
+type Scheduler struct {
+	storage     *data.Storage
+	ch          *amqp.Channel
+	queue       string
+	mu          sync.RWMutex
+	durations   map[string]time.Duration
+	leaseSlack  time.Duration
+	maxAttempts int
+	// finished Оповещения о выражениях, дошедших до конечного статуса
+	finished *notify.Hub
+	// events Поток событий о выражениях
+	events *events.Stream
+}
+
+// New Создание планировщика, объявляет очередь заданий
+func New(storage *data.Storage, ch *amqp.Channel) (*Scheduler, error) {
+	q, err := messages.DeclareQueue(ch, messages.TasksQueue)
+	if err != nil {
+		return nil, fmt.Errorf("cant declare tasks queue: %w", err)
+	}
+	if err := messages.DeclareCancelExchange(ch); err != nil {
+		return nil, fmt.Errorf("cant declare cancel exchange: %w", err)
+	}
+	return &Scheduler{
+		storage: storage,
+		ch:      ch,
+		queue:   q.Name,
+		durations: map[string]time.Duration{
+			"plus":  20 * time.Millisecond,
+			"minus": 20 * time.Millisecond,
+			"mul":   20 * time.Millisecond,
+			"div":   20 * time.Millisecond,
+		},
+		leaseSlack:  10 * time.Second,
+		maxAttempts: 3,
+	}, nil
+}
+
+// SetLease Настройка аренды: запас времени сверх длительности взятой демоном операции и число попыток
+func (s *Scheduler) SetLease(slack time.Duration, maxAttempts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaseSlack = slack
+	s.maxAttempts = maxAttempts
+}
+
+// SetNotify Хаб, в который отправляются id выражений, получивших результат, упавших или отмененных
+func (s *Scheduler) SetNotify(hub *notify.Hub) {
+	s.finished = hub
+}
+
+// SetEvents Поток, в который отправляются события о взятых в работу, посчитанных, упавших и отмененных выражениях
+func (s *Scheduler) SetEvents(stream *events.Stream) {
+	s.events = stream
+}
+
+// SetDurations Установка длительностей вычисления каждой операции
+func (s *Scheduler) SetDurations(d map[string]time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durations = d
+}
+
+// Duration Длительность вычисления операции
+func (s *Scheduler) Duration(op string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.durations[op]
+}
+
+// Submit Разбиение сохраненного выражения на операции и отправка готовых из них
+func (s *Scheduler) Submit(expressionId string, tree arithmetic.Node) error {
+	ops, value := Plan(expressionId, tree)
+	if err := s.storage.AddOperations(ops); err != nil {
+		return fmt.Errorf("cant save operations: %w", err)
+	}
+	return s.Start(expressionId, ops, value)
+}
+
+// Plan Операции выражения в том виде, в каком они сохраняются. Для выражения без операций
+// (одно число) операций нет, а value - его значение.
+func Plan(expressionId string, tree arithmetic.Node) ([]structures.Operation, float64) {
+	steps, value := arithmetic.Decompose(tree)
+	ops := make([]structures.Operation, len(steps))
+	for i, step := range steps {
+		op := structures.Operation{
+			Id:           operationId(expressionId, step.Index),
+			ExpressionId: expressionId,
+			Side:         string(step.Side),
+			Operation:    step.Op.Name(),
+			Status:       "waiting",
+		}
+		if step.Parent >= 0 {
+			op.ParentId = operationId(expressionId, step.Parent)
+		}
+		if step.Left != nil {
+			op.Left, op.LeftReady = *step.Left, true
+		}
+		if step.Right != nil {
+			op.Right, op.RightReady = *step.Right, true
+		}
+		ops[i] = op
+	}
+	return ops, value
+}
+
+// Start Запуск выражения, операции которого (из Plan) уже сохранены: первая попытка и отправка готовых операций.
+// Аренда начнется, когда демон возьмет операцию: в очереди выражение может ждать сколько угодно.
+func (s *Scheduler) Start(expressionId string, ops []structures.Operation, value float64) error {
+	if len(ops) == 0 {
+		return s.finish(expressionId, value)
+	}
+	if err := s.startAttempt(expressionId); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if !op.Ready() {
+			continue
+		}
+		if err := s.dispatch(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleResult Сохранение результата операции. Для корневой операции сохраняет
+// результат выражения, иначе отправляет родителя, если он стал готов.
+// Неконечный результат переводит выражение в failed.
+func (s *Scheduler) HandleResult(res messages.Result) error {
+	if err := arithmetic.CheckFinite(res.Res); err != nil {
+		return s.fail(res.ExpressionId, err)
+	}
+	op, err := s.storage.SaveOperationResult(res.Id, res.Res)
+	if errors.Is(err, data.ErrOperationDone) {
+		log.Println("duplicate result ignored:", res.Id)
+		return nil
+	}
+	if errors.Is(err, data.ErrOperationNotFound) {
+		log.Println("result of deleted operation ignored:", res.Id)
+		return nil
+	}
+	if errors.Is(err, data.ErrOperationCancelled) {
+		log.Println("result of cancelled or failed expression ignored:", res.Id)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cant save operation result: %w", err)
+	}
+	if op.ParentId == "" {
+		return s.finish(op.ExpressionId, res.Res)
+	}
+	if err := s.storage.ReleaseLease(op.ExpressionId); err != nil {
+		return fmt.Errorf("cant release lease of %s: %w", op.ExpressionId, err)
+	}
+	parent, ok := s.storage.GetOperationById(op.ParentId)
+	if !ok {
+		return fmt.Errorf("parent operation %s not found", op.ParentId)
+	}
+	if !parent.Ready() {
+		return nil
+	}
+	return s.dispatch(parent)
+}
+
+// Recover Повторная отправка незавершенного выражения после перезапуска оркестратора.
+// Операции, которые уже могли быть в очереди, отправляются еще раз: повторные результаты игнорируются.
+func (s *Scheduler) Recover(exp structures.Expression) error {
+	return s.retry(exp, true)
+}
+
+// retry Новая попытка выражения: взятые демонами операции отправляются заново, готовые - впервые.
+// Операции, которые еще ждут в очереди, отправляются заново только при requeue (после перезапуска они могли потеряться).
+func (s *Scheduler) retry(exp structures.Expression, requeue bool) error {
+	ops, err := s.storage.GetOperationsByExpression(exp.Id)
+	if err != nil {
+		return fmt.Errorf("cant get operations of %s: %w", exp.Id, err)
+	}
+	if len(ops) == 0 {
+		// Оркестратор упал до сохранения операций
+		tree, err := arithmetic.Parse(exp.Exp)
+		if err != nil {
+			return s.HandleError(messages.Error{ExpressionId: exp.Id, Code: arithmetic.CodeEvaluation, Message: err.Error()})
+		}
+		return s.Submit(exp.Id, tree)
+	}
+	if err := s.startAttempt(exp.Id); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		switch {
+		case op.Status == "done" && op.ParentId == "":
+			// Корень посчитан, но результат выражения не успел сохраниться
+			return s.finish(exp.Id, op.Result)
+		case op.Status == "queued" && op.DaemonId != "":
+			// Демон взял операцию и не ответил за аренду: она снова ждет любого демона
+			if err := s.storage.ReleaseOperation(op.Id); err != nil {
+				return fmt.Errorf("cant release operation %s: %w", op.Id, err)
+			}
+			if err := s.publish(op); err != nil {
+				return err
+			}
+		case op.Status == "queued" && requeue:
+			if err := s.publish(op); err != nil {
+				return err
+			}
+		case op.Status == "waiting" && op.Ready():
+			if err := s.dispatch(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Expire Обработка выражения с истекшей арендой (демон взял операцию и не ответил вовремя):
+// повторная отправка взятых и не отправленных из-за ошибки брокера операций или failed, если попытки кончились. Операции, все еще ждущие
+// в очереди, заново не отправляются, чтобы не раздувать очередь дубликатами.
+func (s *Scheduler) Expire(exp structures.Expression) error {
+	if exp.Attempts >= exp.MaxAttempts {
+		return s.HandleError(messages.Error{
+			ExpressionId: exp.Id,
+			Code:         CodeTimeout,
+			Message:      fmt.Sprintf("expression was not calculated in %d attempts", exp.Attempts),
+		})
+	}
+	log.Println("lease expired, retrying expression:", exp.Id, "attempt", exp.Attempts+1)
+	return s.retry(exp, false)
+}
+
+// startAttempt Новая попытка выражения без аренды
+func (s *Scheduler) startAttempt(expressionId string) error {
+	s.mu.RLock()
+	maxAttempts := s.maxAttempts
+	s.mu.RUnlock()
+	if err := s.storage.StartAttempt(expressionId, maxAttempts); err != nil {
+		return fmt.Errorf("cant start attempt of %s: %w", expressionId, err)
+	}
+	return nil
+}
+
+// extendLease Аренда на время вычисления взятой демоном операции плюс запас
+func (s *Scheduler) extendLease(expressionId, operation string) error {
+	s.mu.RLock()
+	lease := s.leaseSlack + s.durations[operation]
+	s.mu.RUnlock()
+	if err := s.storage.ExtendLease(expressionId, time.Now().Add(lease)); err != nil {
+		return fmt.Errorf("cant extend lease of %s: %w", expressionId, err)
+	}
+	return nil
+}
+
+// HandleError Перевод выражения в failed, если одну из его операций не удалось посчитать.
+// Остальные операции отменяются, а демонам рассылается отмена, как в Cancel.
+func (s *Scheduler) HandleError(e messages.Error) error {
+	failed, err := s.storage.FailExpression(e.ExpressionId, e.Code, e.Message)
+	if err != nil {
+		return fmt.Errorf("cant fail expression %s: %w", e.ExpressionId, err)
+	}
+	if !failed {
+		return nil
+	}
+	log.Println("expression failed:", e.ExpressionId, e.Code, e.Message)
+	s.finished.Notify(e.ExpressionId)
+	s.events.Publish(structures.Event{
+		Type:         events.ExpressionFailed,
+		ExpressionId: e.ExpressionId,
+		Status:       "failed",
+		ErrorCode:    e.Code,
+		Error:        e.Message,
+	})
+	s.broadcastCancel(e.ExpressionId)
+	return nil
+}
+
+// finish Сохранение результата выражения
+func (s *Scheduler) finish(expressionId string, v float64) error {
+	if err := arithmetic.CheckFloat32(v); err != nil {
+		return s.fail(expressionId, err)
+	}
+	saved, err := s.storage.SaveResult(expressionId, float32(v))
+	if err != nil || !saved {
+		return err
+	}
+	s.finished.Notify(expressionId)
+	s.events.Publish(structures.Event{
+		Type:         events.ExpressionDone,
+		ExpressionId: expressionId,
+		Status:       "done",
+		Result:       float32(v),
+	})
+	return nil
+}
+
+// fail Перевод выражения в failed из-за ошибки, найденной оркестратором
+func (s *Scheduler) fail(expressionId string, err error) error {
+	code := arithmetic.CodeEvaluation
+	var evalErr *arithmetic.EvalError
+	if errors.As(err, &evalErr) {
+		code = evalErr.Code
+	}
+	return s.HandleError(messages.Error{ExpressionId: expressionId, Code: code, Message: err.Error()})
+}
+
+// Cancel Отмена незавершенного выражения: его операции больше не отправляются,
+// а демонам рассылается отмена, чтобы они бросили уже взятые задания. false - выражение уже не активно.
+func (s *Scheduler) Cancel(expressionId string) (bool, error) {
+	cancelled, err := s.storage.CancelExpression(expressionId)
+	if err != nil || !cancelled {
+		return false, err
+	}
+	s.finished.Notify(expressionId)
+	s.events.Publish(structures.Event{Type: events.ExpressionCancelled, ExpressionId: expressionId, Status: "cancelled"})
+	s.broadcastCancel(expressionId)
+	return true, nil
+}
+
+// broadcastCancel Рассылка демонам отмены заданий выражения, которое больше не считается
+func (s *Scheduler) broadcastCancel(expressionId string) {
+	err := messages.Broadcast(s.ch, messages.CancelExchange, messages.Cancel{ExpressionId: expressionId})
+	if err != nil {
+		// Не страшно: результаты отмененных операций все равно игнорируются
+		log.Println("cant broadcast cancellation:", expressionId, err.Error())
+	}
+}
+
+// HandlePickup Запись о том, что демон взял операцию в работу, с этого момента идет аренда выражения
+func (s *Scheduler) HandlePickup(p messages.Pickup) error {
+	assigned, err := s.storage.AssignOperation(p.Id, p.DaemonId)
+	if err != nil {
+		return fmt.Errorf("cant assign operation %s: %w", p.Id, err)
+	}
+	if assigned {
+		op, ok := s.storage.GetOperationById(p.Id)
+		if ok {
+			if err := s.extendLease(p.ExpressionId, op.Operation); err != nil {
+				return err
+			}
+		}
+		s.events.Publish(structures.Event{
+			Type:         events.ExpressionPickedUp,
+			ExpressionId: p.ExpressionId,
+			OperationId:  p.Id,
+			DaemonId:     p.DaemonId,
+			Status:       "active",
+		})
+	}
+	return nil
+}
+
+// Reassign Повторная отправка операций, которые были в работе у умершего демона
+func (s *Scheduler) Reassign(daemonId string) (int, error) {
+	ops, err := s.storage.ReassignOperations(daemonId)
+	if err != nil {
+		return 0, fmt.Errorf("cant reassign operations of %s: %w", daemonId, err)
+	}
+	for _, op := range ops {
+		if err := s.publish(op); err != nil {
+			return 0, err
+		}
+		log.Println("operation reassigned:", op.Id, "from daemon", daemonId)
+	}
+	for _, op := range ops {
+		if err := s.storage.ReleaseLease(op.ExpressionId); err != nil {
+			return 0, fmt.Errorf("cant release lease of %s: %w", op.ExpressionId, err)
+		}
+	}
+	return len(ops), nil
+}
+
+// dispatch Отправка операции в очередь, если она еще не отправлена
+func (s *Scheduler) dispatch(op structures.Operation) error {
+	claimed, err := s.storage.ClaimOperation(op.Id)
+	if err != nil {
+		return fmt.Errorf("cant claim operation %s: %w", op.Id, err)
+	}
+	if !claimed {
+		return nil
+	}
+	return s.publish(op)
+}
+
+// publish Публикация операции в очередь заданий
+func (s *Scheduler) publish(op structures.Operation) error {
+	task := messages.Task{
+		Id:           op.Id,
+		ExpressionId: op.ExpressionId,
+		Operation:    op.Operation,
+		Left:         op.Left,
+		Right:        op.Right,
+		Duration:     s.Duration(op.Operation),
+	}
+	err := messages.Publish(s.ch, s.queue, task)
+	if err != nil {
+		s.postpone(op)
+		return fmt.Errorf("cant publish task %s: %w", op.Id, err)
+	}
+	log.Println("task published:", op.Id)
+	return nil
+}
+
+// postpone Неотправленная операция снова ждет отправки, а аренда выражения дает LeaseSweeper
+// повторить ее (Expire). Без этого операция числилась бы в очереди и выражение висело бы до перезапуска.
+func (s *Scheduler) postpone(op structures.Operation) {
+	if err := s.storage.UnclaimOperation(op.Id); err != nil {
+		log.Println("ERROR: cant unclaim operation", op.Id, err.Error())
+		return
+	}
+	if err := s.extendLease(op.ExpressionId, op.Operation); err != nil {
+		log.Println("ERROR: ", err.Error())
+	}
+}
+
+func operationId(expressionId string, index int) string {
+	return fmt.Sprintf("%s-%d", expressionId, index)
+}
@@ -0,0 +1,733 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/j0pl0p/final-task-GO-YL/api"
+	"github.com/j0pl0p/final-task-GO-YL/arithmetic"
+	"github.com/j0pl0p/final-task-GO-YL/auth"
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/events"
+	"github.com/j0pl0p/final-task-GO-YL/notify"
+	"github.com/j0pl0p/final-task-GO-YL/ratelimit"
+	"github.com/j0pl0p/final-task-GO-YL/scheduler"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"github.com/j0pl0p/final-task-GO-YL/webhook"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Размер страницы списка выражений по умолчанию и максимальный
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// MaxBatchSize Больше выражений в одной пачке не принимается
+const MaxBatchSize = 1000
+
+// MaxSubscriptions Больше выражений одно соединение не отслеживает
+const MaxSubscriptions = 1000
+
+// eventsPage По сколько пропущенных событий читать из базы при переподключении
+const eventsPage = 500
+
+// ErrStreamDropped Поток событий отключил подписку: клиент не успевал их забирать
+var ErrStreamDropped = errors.New("event stream dropped")
+
+// Service Операции с выражениями, общие для HTTP, WebSocket и gRPC API: добавление (по одному и пачками),
+// получение с ожиданием результата, списки, отмена и события. Ошибки для клиента - *api.Error со статусом HTTP,
+// каждый API переводит их в свой формат.
+type Service struct {
+	storage     *data.Storage
+	sched       *scheduler.Scheduler
+	events      *events.Stream
+	finished    *notify.Hub
+	webhooks    *webhook.Sender
+	userLimiter *ratelimit.Limiter
+	ipLimiter   *ratelimit.Limiter
+	dailyOps    int
+	maxWait     time.Duration
+}
+
+// New Создание сервиса поверх хранилища, планировщика, потока событий и хаба оповещений о завершенных выражениях
+func New(storage *data.Storage, sched *scheduler.Scheduler, stream *events.Stream, finished *notify.Hub) *Service {
+	return &Service{
+		storage:     storage,
+		sched:       sched,
+		events:      stream,
+		finished:    finished,
+		userLimiter: ratelimit.New(0, 0),
+		ipLimiter:   ratelimit.New(0, 0),
+		maxWait:     time.Minute,
+	}
+}
+
+// SetLimits Ограничения частоты отправки по пользователю и по IP, дневная квота операций (0 - без квоты)
+// и самое долгое ожидание результата
+func (s *Service) SetLimits(user, ip *ratelimit.Limiter, dailyOps int, maxWait time.Duration) {
+	s.userLimiter = user
+	s.ipLimiter = ip
+	s.dailyOps = dailyOps
+	s.maxWait = maxWait
+}
+
+// SetWebhooks Отправитель callback'ов, без него callback_url отвергается
+func (s *Service) SetWebhooks(sender *webhook.Sender) {
+	s.webhooks = sender
+}
+
+// Submit Разбор выражения, проверка ограничений и постановка в очередь. remoteAddr - адрес клиента host:port для лимита по IP.
+// created == false, если пользователь уже добавлял это выражение: тогда возвращается существующее.
+func (s *Service) Submit(remoteAddr string, user auth.User, req structures.ExpressionDataJSON) (structures.Expression, bool, error) {
+	if err := s.checkRateLimits(remoteAddr, user, 1); err != nil {
+		return structures.Expression{}, false, err
+	}
+	// Дедупликация в пределах пользователя: у двух пользователей одно выражение дает разные записи
+	id := stringToHash(user.Id + "\n" + req.Exp)
+	tree, err := arithmetic.Parse(req.Exp)
+	if err != nil {
+		log.Println("ERROR: invalid expression: ", err)
+		return structures.Expression{}, false, &api.Error{
+			Status:  422,
+			Code:    api.CodeInvalidExpression,
+			Message: err.Error(),
+			Details: expressionError(err),
+		}
+	}
+	if err := s.checkCallbackURL(req.CallbackURL); err != nil {
+		return structures.Expression{}, false, err
+	}
+	callback, err := newCallback(req.CallbackURL)
+	if err != nil {
+		return structures.Expression{}, false, err
+	}
+	exp := data.NewExpression{
+		Id:       id,
+		Exp:      req.Exp,
+		UserId:   user.Id,
+		ExpHash:  stringToHash(tree.String()),
+		Callback: callback,
+	}
+	if req.UseCache {
+		exp.Result, exp.Cached = s.storage.FindCachedResult(exp.ExpHash)
+	}
+	var value float64
+	if !exp.Cached {
+		exp.Operations, value = scheduler.Plan(id, tree)
+	}
+	// Выражение сохраняется вместе с операциями и callback'ом, квота списывается в той же транзакции:
+	// выражение без callback'а успело бы завершиться и ничего не отправить, а повторное квоту не тратит
+	added, err := s.storage.AddExpression(exp, s.quota(user))
+	if err != nil {
+		return structures.Expression{}, false, s.addError(user, err)
+	}
+	if !added {
+		// Пользователь уже добавлял это выражение (может быть, одновременно с этим запросом), callback остается прежним
+		stored, ok := s.storage.GetExpressionById(id)
+		if !ok {
+			return structures.Expression{}, false, fmt.Errorf("expression %s exists but cant be read", id)
+		}
+		log.Println("expression already exists: ", id)
+		return stored, false, nil
+	}
+	if exp.Cached {
+		log.Println("expression added from cache: ", id)
+		s.events.Publish(structures.Event{Type: events.ExpressionCreated, ExpressionId: id, Status: "done", Result: exp.Result})
+		return s.storedExpression(id, callback.Secret)
+	}
+	log.Println("expression added: ", id)
+	s.events.Publish(structures.Event{Type: events.ExpressionCreated, ExpressionId: id, Status: "active"})
+	// Выражение уже сохранено: если отправить не вышло, его повторит аренда или восстановление при перезапуске
+	if err := s.sched.Start(id, exp.Operations, value); err != nil {
+		log.Println("cant schedule the expression: ", id, err)
+	} else {
+		log.Println("successfully scheduled expression")
+	}
+	return s.storedExpression(id, callback.Secret)
+}
+
+// SubmitBatch Проверка каждого выражения пачки, сохранение принятых одной транзакцией и отправка их операций.
+// Кривые выражения не мешают остальным: для них в пачке сохраняется причина отказа.
+func (s *Service) SubmitBatch(remoteAddr string, user auth.User, items []structures.ExpressionDataJSON) (structures.BatchJSON, error) {
+	if len(items) == 0 {
+		return structures.BatchJSON{}, api.Errorf(422, api.CodeValidation, "batch is empty")
+	}
+	if len(items) > MaxBatchSize {
+		return structures.BatchJSON{}, api.Errorf(422, api.CodeValidation, "batch has %d expressions, at most %d allowed", len(items), MaxBatchSize)
+	}
+	if err := s.checkRateLimits(remoteAddr, user, len(items)); err != nil {
+		return structures.BatchJSON{}, err
+	}
+	// Значения выражений-констант, у которых нет операций
+	values := map[string]float64{}
+	batch := structures.Batch{Id: uuid.NewString(), UserId: user.Id, Total: len(items), CreatedAt: time.Now()}
+	batchItems := make([]structures.BatchItem, len(items))
+	var exps []data.NewExpression
+	// Ключи callback'ов по позициям, попадают только в этот ответ
+	secrets := map[int]string{}
+	seen := map[string]bool{}
+	for i, item := range items {
+		batchItems[i].Position = i
+		tree, err := arithmetic.Parse(item.Exp)
+		if err != nil {
+			batchItems[i].ErrorCode, batchItems[i].Error = api.CodeInvalidExpression, err.Error()
+			batch.Rejected++
+			continue
+		}
+		if err := s.checkCallbackURL(item.CallbackURL); err != nil {
+			e := api.AsError(err)
+			batchItems[i].ErrorCode, batchItems[i].Error = e.Code, e.Message
+			batch.Rejected++
+			continue
+		}
+		id := stringToHash(user.Id + "\n" + item.Exp)
+		batchItems[i].ExpressionId = id
+		if seen[id] {
+			batchItems[i].Duplicate = true
+			continue
+		}
+		seen[id] = true
+		callback, err := newCallback(item.CallbackURL)
+		if err != nil {
+			return structures.BatchJSON{}, err
+		}
+		secrets[i] = callback.Secret
+		exp := data.NewExpression{
+			Id:       id,
+			Exp:      item.Exp,
+			UserId:   user.Id,
+			ExpHash:  stringToHash(tree.String()),
+			Callback: callback,
+		}
+		if item.UseCache {
+			exp.Result, exp.Cached = s.storage.FindCachedResult(exp.ExpHash)
+		}
+		if !exp.Cached {
+			exp.Operations, values[id] = scheduler.Plan(id, tree)
+		}
+		exps = append(exps, exp)
+	}
+	if batch.Rejected == len(items) {
+		res := batchJSON(batch, batchItems, nil)
+		return structures.BatchJSON{}, &api.Error{
+			Status:  422,
+			Code:    api.CodeInvalidExpression,
+			Message: "no valid expressions in the batch",
+			Details: res.Items,
+		}
+	}
+	// Уже добавленные пользователем выражения пропускаются в транзакции, квота списывается только за новые
+	added, err := s.storage.AddBatch(batch, batchItems, exps, s.quota(user))
+	if err != nil {
+		return structures.BatchJSON{}, s.addError(user, err)
+	}
+	log.Println("batch added: ", batch.Id, "expressions:", len(added), "rejected:", batch.Rejected)
+	for _, exp := range added {
+		if exp.Cached {
+			s.events.Publish(structures.Event{Type: events.ExpressionCreated, ExpressionId: exp.Id, Status: "done", Result: exp.Result})
+			continue
+		}
+		s.events.Publish(structures.Event{Type: events.ExpressionCreated, ExpressionId: exp.Id, Status: "active"})
+		// Выражение уже сохранено: если отправить не вышло, его повторит аренда или восстановление при перезапуске
+		if err := s.sched.Start(exp.Id, exp.Operations, values[exp.Id]); err != nil {
+			log.Println("cant schedule the expression: ", exp.Id, err)
+		}
+	}
+	res, err := s.batchProgress(batch, true)
+	if err != nil {
+		return structures.BatchJSON{}, err
+	}
+	for i := range res.Items {
+		// У повтора callback прежний, а ключ нового не сохранен
+		if !res.Items[i].Duplicate {
+			res.Items[i].CallbackSecret = secrets[res.Items[i].Index]
+		}
+	}
+	return res, nil
+}
+
+// Batch Прогресс пачки пользователя, с withItems еще и статусы всех ее выражений. Чужие пачки не видны.
+func (s *Service) Batch(user auth.User, id string, withItems bool) (structures.BatchJSON, error) {
+	batch, ok := s.storage.GetBatch(id)
+	if !ok || batch.UserId != user.Id {
+		return structures.BatchJSON{}, api.Errorf(404, api.CodeNotFound, "such batch doesnt exist")
+	}
+	return s.batchProgress(batch, withItems)
+}
+
+// Get Выражение пользователя по id, чужие выражения не видны. С wait > 0 ждет, пока активное выражение
+// не завершится (результат, ошибка или отмена), но не дольше wait и не дольше maxWait.
+func (s *Service) Get(ctx context.Context, user auth.User, id string, wait time.Duration) (structures.Expression, error) {
+	wait, err := s.limitWait(wait)
+	if err != nil {
+		return structures.Expression{}, err
+	}
+	exp, ok := s.storage.GetExpressionById(id)
+	if !ok || exp.UserId != user.Id {
+		return structures.Expression{}, api.Errorf(404, api.CodeNotFound, "such expression doesnt exist")
+	}
+	return s.waitExpression(ctx, exp, wait), nil
+}
+
+// ListRequest Параметры списка выражений: Status (любой из), From и To (RFC 3339), Q (поиск по тексту),
+// Sort (created_at, status, expression, result; с "-" по убыванию), Cursor, Limit (0 - по умолчанию)
+// и Owner (только для админа, "all" - выражения всех пользователей)
+type ListRequest struct {
+	Status []string
+	From   string
+	To     string
+	Q      string
+	Sort   string
+	Cursor string
+	Limit  int
+	Owner  string
+}
+
+// Page Страница выражений, NextCursor пустой на последней
+type Page struct {
+	Expressions []structures.Expression
+	NextCursor  string
+	Limit       int
+}
+
+// List Страница выражений пользователя, defaultLimit - размер страницы, если Limit не указан (0 - без ограничения)
+func (s *Service) List(user auth.User, req ListRequest, defaultLimit int) (Page, error) {
+	q := data.ExpressionQuery{
+		UserId: user.Id,
+		Status: req.Status,
+		Search: req.Q,
+		Sort:   "created_at",
+		Desc:   true,
+		Cursor: req.Cursor,
+		Limit:  defaultLimit,
+	}
+	if req.Owner != "" && req.Owner != user.Id {
+		if user.Role != auth.RoleAdmin {
+			return Page{}, api.Errorf(403, api.CodeForbidden, "only admins can list expressions of other users")
+		}
+		q.UserId = req.Owner
+		if req.Owner == "all" {
+			q.UserId = ""
+		}
+	}
+	bounds := []struct {
+		name  string
+		value string
+		t     *time.Time
+	}{{"from", req.From, &q.From}, {"to", req.To, &q.To}}
+	for _, b := range bounds {
+		if b.value != "" {
+			parsed, err := time.Parse(time.RFC3339, b.value)
+			if err != nil {
+				return Page{}, api.Errorf(422, api.CodeValidation, "%s must be an RFC 3339 time", b.name)
+			}
+			*b.t = parsed
+		}
+	}
+	if req.Sort != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(req.Sort, "-"), strings.HasPrefix(req.Sort, "-")
+		if !data.IsExpressionSort(q.Sort) {
+			return Page{}, api.Errorf(422, api.CodeValidation, "unknown sort %q", q.Sort)
+		}
+	}
+	if req.Limit != 0 {
+		if req.Limit < 1 || req.Limit > MaxPageSize {
+			return Page{}, api.Errorf(422, api.CodeValidation, "limit must be between 1 and %d", MaxPageSize)
+		}
+		q.Limit = req.Limit
+	}
+	list, next, err := s.storage.ListExpressions(q)
+	if errors.Is(err, data.ErrInvalidCursor) {
+		return Page{}, api.Errorf(400, api.CodeBadRequest, "invalid cursor")
+	}
+	if err != nil {
+		return Page{}, err
+	}
+	return Page{Expressions: list, NextCursor: next, Limit: q.Limit}, nil
+}
+
+// Cancel Отмена активного выражения пользователя. cancelled == false, если выражение уже завершено.
+func (s *Service) Cancel(user auth.User, id string) (structures.Expression, bool, error) {
+	exp, ok := s.storage.GetExpressionById(id)
+	if !ok || exp.UserId != user.Id {
+		return structures.Expression{}, false, api.Errorf(404, api.CodeNotFound, "such expression doesnt exist")
+	}
+	if exp.Status != "active" {
+		return exp, false, nil
+	}
+	cancelled, err := s.sched.Cancel(id)
+	if err != nil {
+		return structures.Expression{}, false, err
+	}
+	if !cancelled {
+		return exp, false, nil
+	}
+	log.Println("expression cancelled: ", id)
+	exp.Status = "cancelled"
+	return exp, true, nil
+}
+
+// CancelOrDelete Отмена активного выражения пользователя или удаление уже завершенного (deleted == true)
+func (s *Service) CancelOrDelete(user auth.User, id string) (structures.Expression, bool, error) {
+	exp, cancelled, err := s.Cancel(user, id)
+	if err != nil {
+		return structures.Expression{}, false, err
+	}
+	// Если выражение успело завершиться, оно удаляется как завершенное
+	if cancelled {
+		return exp, false, nil
+	}
+	found, err := s.storage.DeleteExpression(id)
+	if err != nil {
+		return structures.Expression{}, false, err
+	}
+	if !found {
+		return structures.Expression{}, false, api.Errorf(404, api.CodeNotFound, "such expression doesnt exist")
+	}
+	log.Println("expression deleted: ", id)
+	return exp, true, nil
+}
+
+// Callback Callback выражения пользователя и попытки его доставки
+func (s *Service) Callback(user auth.User, id string) (structures.WebhookJSON, error) {
+	exp, ok := s.storage.GetExpressionById(id)
+	if !ok || exp.UserId != user.Id {
+		return structures.WebhookJSON{}, api.Errorf(404, api.CodeNotFound, "such expression doesnt exist")
+	}
+	hook, ok := s.storage.GetWebhook(id)
+	if !ok {
+		return structures.WebhookJSON{}, api.Errorf(404, api.CodeNotFound, "the expression has no callback")
+	}
+	attempts, err := s.storage.GetWebhookAttempts(id)
+	if err != nil {
+		return structures.WebhookJSON{}, err
+	}
+	res := structures.WebhookJSON{
+		URL:        hook.URL,
+		State:      hook.State,
+		Attempts:   hook.Attempts,
+		Deliveries: make([]structures.WebhookAttemptJSON, len(attempts)),
+	}
+	if !hook.NextAttemptAt.IsZero() && hook.State == "pending" {
+		res.NextAttemptAt = &hook.NextAttemptAt
+	}
+	if !hook.DeliveredAt.IsZero() {
+		res.DeliveredAt = &hook.DeliveredAt
+	}
+	for i, a := range attempts {
+		res.Deliveries[i] = structures.WebhookAttemptJSON{
+			Attempt:    a.Attempt,
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+			DurationMs: a.Duration.Milliseconds(),
+			CreatedAt:  a.CreatedAt,
+		}
+	}
+	return res, nil
+}
+
+// Quota Использование дневной квоты операций пользователем на сегодня
+func (s *Service) Quota(user auth.User) (structures.QuotaJSON, error) {
+	day, resetsAt := quotaDay(time.Now())
+	used, err := s.storage.GetUsage(user.Id, day)
+	if err != nil {
+		return structures.QuotaJSON{}, err
+	}
+	quota := structures.QuotaJSON{Day: day, Used: used, Limit: s.dailyOps, ResetsAt: resetsAt}
+	if s.dailyOps > 0 {
+		quota.Remaining = max(0, s.dailyOps-used)
+	}
+	return quota, nil
+}
+
+// Agents Список агентов
+func (s *Service) Agents() ([]structures.Daemon, error) {
+	daemons, err := s.storage.GetAllDaemons()
+	if err != nil {
+		return nil, err
+	}
+	if daemons == nil {
+		daemons = []structures.Daemon{}
+	}
+	return daemons, nil
+}
+
+// Watcher Подписка на события пользователя (и события демонов): сначала пропущенные, потом новые, без повторов
+type Watcher struct {
+	s       *Service
+	user    auth.User
+	sub     *events.Subscription
+	lastId  int64
+	resume  bool
+	backlog []structures.Event
+}
+
+// Watch Подписка на события пользователя. С resume сначала отдаются события после lastId из таблицы Events.
+// Подписка оформляется сразу, до чтения пропущенного, чтобы между ними ничего не потерялось. Закрывается Close.
+func (s *Service) Watch(user auth.User, lastId int64, resume bool) *Watcher {
+	return &Watcher{s: s, user: user, sub: s.events.Subscribe(user.Id), lastId: lastId, resume: resume}
+}
+
+// Close Отписка от событий
+func (w *Watcher) Close() {
+	w.s.events.Unsubscribe(w.sub)
+}
+
+// Next Следующее событие. ok == false, если за idle ничего не пришло (idle 0 - ждать без ограничения).
+// Возвращает ошибку ctx, если он отменен, и ErrStreamDropped, если поток отключил медленного подписчика:
+// тогда пропущенное можно догнать новой подпиской с номером последнего полученного события.
+func (w *Watcher) Next(ctx context.Context, idle time.Duration) (structures.Event, bool, error) {
+	for w.resume && len(w.backlog) == 0 {
+		missed, err := w.s.events.Since(w.user.Id, w.lastId, eventsPage)
+		if err != nil {
+			return structures.Event{}, false, fmt.Errorf("cant get missed events: %w", err)
+		}
+		w.backlog = missed
+		w.resume = len(missed) == eventsPage
+	}
+	if len(w.backlog) > 0 {
+		e := w.backlog[0]
+		w.backlog = w.backlog[1:]
+		w.lastId = e.Id
+		return e, true, nil
+	}
+	var timeout <-chan time.Time
+	if idle > 0 {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case e, ok := <-w.sub.C:
+			if !ok {
+				return structures.Event{}, false, ErrStreamDropped
+			}
+			// Уже отданное из таблицы
+			if e.Id <= w.lastId {
+				continue
+			}
+			w.lastId = e.Id
+			return e, true, nil
+		case <-timeout:
+			return structures.Event{}, false, nil
+		case <-ctx.Done():
+			return structures.Event{}, false, ctx.Err()
+		}
+	}
+}
+
+// EventExpression Выражение события: берется из базы, статус, результат и ошибка - из самого события
+func (s *Service) EventExpression(e structures.Event) structures.Expression {
+	exp, ok := s.storage.GetExpressionById(e.ExpressionId)
+	if !ok {
+		exp = structures.Expression{Id: e.ExpressionId, UserId: e.UserId}
+	}
+	if e.Status != "" {
+		exp.Status = e.Status
+	}
+	exp.Result = e.Result
+	exp.ErrorCode, exp.Error = e.ErrorCode, e.Error
+	return exp
+}
+
+// Проверка callback URL: абсолютный http(s) адрес не во внутренней сети, и callback'и должны быть включены (-webhooks)
+func (s *Service) checkCallbackURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if s.webhooks == nil {
+		return api.Errorf(422, api.CodeValidation, "callbacks are disabled on this server")
+	}
+	if err := s.webhooks.ValidateURL(raw); err != nil {
+		return api.Errorf(422, api.CodeValidation, "%s", err)
+	}
+	return nil
+}
+
+// Только что добавленное выражение в том виде, в каком оно сохранено, с ключом его callback'а (отдается один раз)
+func (s *Service) storedExpression(id, callbackSecret string) (structures.Expression, bool, error) {
+	exp, ok := s.storage.GetExpressionById(id)
+	if !ok {
+		return structures.Expression{}, false, fmt.Errorf("expression %s disappeared after adding", id)
+	}
+	exp.CallbackSecret = callbackSecret
+	return exp, true, nil
+}
+
+// Проверка ограничений частоты отправки выражений по IP (из адреса клиента host:port) и по пользователю, при превышении 429.
+// n - сколько выражений отправляется: каждое выражение пачки стоит одного токена.
+func (s *Service) checkRateLimits(remoteAddr string, user auth.User, n int) error {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	if ok, wait := s.ipLimiter.AllowN(ip, n); !ok {
+		log.Println("ERROR: ip rate limit exceeded: ", ip)
+		return tooManyRequests(wait, api.CodeRateLimited, "too many requests from this IP")
+	}
+	if ok, wait := s.userLimiter.AllowN(user.Id, n); !ok {
+		s.ipLimiter.Refund(ip, n)
+		log.Println("ERROR: user rate limit exceeded: ", user.Login)
+		return tooManyRequests(wait, api.CodeRateLimited, "too many requests from this user")
+	}
+	return nil
+}
+
+// Дневная квота пользователя на текущие сутки (UTC)
+func (s *Service) quota(user auth.User) data.Quota {
+	day, _ := quotaDay(time.Now())
+	limit := s.dailyOps
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	return data.Quota{UserId: user.Id, Day: day, Limit: limit}
+}
+
+// Ошибка сохранения выражений: нехватка квоты - 429 до конца суток (UTC), остальное - внутренняя ошибка
+func (s *Service) addError(user auth.User, err error) error {
+	var quotaErr *data.QuotaError
+	if errors.As(err, &quotaErr) {
+		log.Println("ERROR: daily quota exceeded: ", user.Login)
+		_, resetsAt := quotaDay(time.Now())
+		return tooManyRequests(time.Until(resetsAt), api.CodeQuotaExceeded, quotaErr.Error())
+	}
+	return fmt.Errorf("cant add expression: %w", err)
+}
+
+// Проверка длительности ожидания: отрицательная - ошибка, больше maxWait урезается до maxWait
+func (s *Service) limitWait(wait time.Duration) (time.Duration, error) {
+	if wait < 0 {
+		return 0, api.Errorf(422, api.CodeValidation, "wait cant be negative")
+	}
+	if wait > s.maxWait {
+		wait = s.maxWait
+	}
+	return wait, nil
+}
+
+// Ожидание, пока активное выражение не завершится (результат, ошибка или отмена), но не дольше wait.
+// Будит оповещение планировщика через finished, а не опрос базы. Возвращает выражение после ожидания.
+func (s *Service) waitExpression(ctx context.Context, exp structures.Expression, wait time.Duration) structures.Expression {
+	if wait <= 0 || exp.Status != "active" {
+		return exp
+	}
+	done, unsubscribe := s.finished.Subscribe(exp.Id)
+	defer unsubscribe()
+	// Выражение могло завершиться между первым чтением и подпиской
+	if fresh, ok := s.storage.GetExpressionById(exp.Id); ok {
+		exp = fresh
+	}
+	if exp.Status != "active" {
+		return exp
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+		return exp
+	}
+	if fresh, ok := s.storage.GetExpressionById(exp.Id); ok {
+		exp = fresh
+	}
+	return exp
+}
+
+// Прогресс пачки по текущим статусам ее выражений
+func (s *Service) batchProgress(batch structures.Batch, withItems bool) (structures.BatchJSON, error) {
+	counts, err := s.storage.GetBatchCounts(batch.Id)
+	if err != nil {
+		return structures.BatchJSON{}, err
+	}
+	var items []structures.BatchItem
+	if withItems {
+		items, err = s.storage.GetBatchItems(batch.Id)
+		if err != nil {
+			return structures.BatchJSON{}, err
+		}
+	}
+	return batchJSON(batch, items, counts), nil
+}
+
+func batchJSON(batch structures.Batch, items []structures.BatchItem, counts map[string]int) structures.BatchJSON {
+	if counts == nil {
+		counts = map[string]int{}
+	}
+	res := structures.BatchJSON{
+		Id:        batch.Id,
+		CreatedAt: batch.CreatedAt,
+		Total:     batch.Total,
+		Rejected:  batch.Rejected,
+		Counts:    counts,
+		Finished:  counts["active"] == 0,
+	}
+	for _, item := range items {
+		j := structures.BatchItemJSON{
+			Index:     item.Position,
+			Id:        item.ExpressionId,
+			Status:    item.Status,
+			Duplicate: item.Duplicate,
+		}
+		if item.ErrorCode != "" {
+			j.Error = &structures.ErrorJSON{Code: item.ErrorCode, Message: item.Error}
+		}
+		res.Items = append(res.Items, j)
+	}
+	return res
+}
+
+// Callback нового выражения со своим ключом подписи, пустой - если callbackURL не указан
+func newCallback(callbackURL string) (structures.Webhook, error) {
+	if callbackURL == "" {
+		return structures.Webhook{}, nil
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		return structures.Webhook{}, fmt.Errorf("cant generate callback secret: %w", err)
+	}
+	return structures.Webhook{URL: callbackURL, Secret: secret}, nil
+}
+
+// Описание ошибки разбора выражения с позицией и токеном
+func expressionError(err error) structures.ExpressionErrorJSON {
+	resp := structures.ExpressionErrorJSON{Message: err.Error()}
+	var parseErr *arithmetic.Error
+	if errors.As(err, &parseErr) {
+		resp = structures.ExpressionErrorJSON{
+			Message: parseErr.Message,
+			Offset:  parseErr.Offset,
+			Token:   parseErr.Token,
+		}
+	}
+	return resp
+}
+
+// Текущие сутки квоты и время их окончания
+func quotaDay(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.Add(24 * time.Hour)
+}
+
+// Ошибка 429, Retry-After в секундах
+func tooManyRequests(wait time.Duration, code, msg string) error {
+	return &api.Error{Status: 429, Code: code, Message: msg, RetryAfter: wait}
+}
+
+// Хеширование строки str
+func stringToHash(str string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(str))
+	hashedString := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	return hashedString
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/j0pl0p/final-task-GO-YL/api"
+	"github.com/j0pl0p/final-task-GO-YL/auth"
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/ratelimit"
+)
+
+func TestCheckRateLimits(t *testing.T) {
+	// По IP 5 выражений, по пользователю 3, оба пополняются на одно в секунду
+	s := New(nil, nil, nil, nil)
+	s.SetLimits(ratelimit.New(60, 3), ratelimit.New(60, 5), 0, time.Minute)
+	alice := auth.User{Id: "u1", Login: "alice"}
+	bob := auth.User{Id: "u2", Login: "bob"}
+	carol := auth.User{Id: "u3", Login: "carol"}
+	steps := []struct {
+		name string
+		user auth.User
+		addr string
+		n    int
+		wait time.Duration // 0 - запрос проходит
+	}{
+		{"batch of two", alice, "10.0.0.1:1000", 2, 0},
+		{"batch over the user limit", alice, "10.0.0.1:1001", 2, time.Second},
+		{"single", alice, "10.0.0.1:1002", 1, 0},
+		{"user limit is spent", alice, "10.0.0.1:1003", 1, time.Second},
+		// Отказы по пользователю вернули токены IP: у него осталось 2
+		{"other user from the same IP", bob, "10.0.0.1:1004", 2, 0},
+		{"IP limit is spent", bob, "10.0.0.1:1005", 1, time.Second},
+		{"other IP", bob, "10.0.0.2:1000", 1, 0},
+		{"address without port", carol, "10.0.0.3", 1, 0},
+	}
+	for _, st := range steps {
+		err := s.checkRateLimits(st.addr, st.user, st.n)
+		if st.wait == 0 {
+			if err != nil {
+				t.Fatalf("%s: error = %v", st.name, err)
+			}
+			continue
+		}
+		var apiErr *api.Error
+		if !errors.As(err, &apiErr) || apiErr.Status != 429 || apiErr.Code != api.CodeRateLimited {
+			t.Fatalf("%s: error = %v, want 429 %s", st.name, err, api.CodeRateLimited)
+		}
+		if apiErr.RetryAfter > st.wait || apiErr.RetryAfter < st.wait-50*time.Millisecond {
+			t.Errorf("%s: RetryAfter = %v, want %v", st.name, apiErr.RetryAfter, st.wait)
+		}
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Millisecond, "1"},
+		{90 * time.Minute, "5400"},
+		{0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wait.String(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.WriteError(w, tooManyRequests(tt.wait, api.CodeRateLimited, "too many requests"))
+			if w.Code != 429 {
+				t.Errorf("status = %d", w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaDay(t *testing.T) {
+	msk := time.FixedZone("MSK", 3*60*60)
+	tests := []struct {
+		now    time.Time
+		day    string
+		resets time.Time
+	}{
+		{time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), "2024-01-02", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), "2024-01-02", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC), "2024-12-31", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Сутки по UTC: в Москве 2 января 01:00 это еще 1 января
+		{time.Date(2024, 1, 2, 1, 0, 0, 0, msk), "2024-01-01", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.now.String(), func(t *testing.T) {
+			day, resets := quotaDay(tt.now)
+			if day != tt.day || !resets.Equal(tt.resets) {
+				t.Errorf("quotaDay = %s, %v, want %s, %v", day, resets, tt.day, tt.resets)
+			}
+		})
+	}
+}
+
+func TestAddError(t *testing.T) {
+	s := New(nil, nil, nil, nil)
+	user := auth.User{Id: "u1", Login: "alice"}
+	err := s.addError(user, fmt.Errorf("add batch: %w", &data.QuotaError{Used: 9, Limit: 10, Ops: 2}))
+	var apiErr *api.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 429 || apiErr.Code != api.CodeQuotaExceeded {
+		t.Fatalf("quota error = %v", err)
+	}
+	_, resets := quotaDay(time.Now())
+	if d := apiErr.RetryAfter - time.Until(resets); d < 0 || d > time.Second {
+		t.Errorf("RetryAfter = %v, quota resets at %v", apiErr.RetryAfter, resets)
+	}
+	if err := s.addError(user, errors.New("disk is full")); api.AsError(err).Status != 500 {
+		t.Errorf("other error = %v", err)
+	}
+}
@@ -1,8 +1,27 @@
 package structures
 
+import "time"
+
 // ExpressionDataJSON жсончик для получения данных о выражении
 type ExpressionDataJSON struct {
-	Exp string `json:"expression"`
+	Exp         string `json:"expression"`
+	UseCache    bool   `json:"use_cache"`
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// ExpressionErrorJSON жсончик с ошибкой разбора выражения
+type ExpressionErrorJSON struct {
+	Message string `json:"message"`
+	Offset  int    `json:"offset"`
+	Token   string `json:"token"`
+}
+
+// ExpressionFailedJSON жсончик с причиной, по которой выражение не удалось посчитать
+type ExpressionFailedJSON struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code"`
+	Error  string `json:"error"`
 }
 
 // IdReceiveJSON жсончик для получения айдишника
@@ -20,8 +39,284 @@ type CalcDurationsJSON struct {
 
 // Expression Структура выражения
 type Expression struct {
-	Exp    string
-	Id     string
-	Status string
-	Result float32
+	Exp         string
+	Id          string
+	Status      string
+	Result      float32
+	Error       string
+	ErrorCode   string
+	Attempts    int
+	MaxAttempts int
+	UserId      string
+	CreatedAt   time.Time
+	// CallbackSecret Ключ подписи callback'а, есть только в ответе на добавление, в базе его у выражения не читают
+	CallbackSecret string
+}
+
+// Batch Структура пачки выражений, отправленных одним запросом
+type Batch struct {
+	Id        string
+	UserId    string
+	Total     int
+	Rejected  int
+	CreatedAt time.Time
+}
+
+// BatchItem Структура одного выражения пачки: id принятого или причина отказа.
+// Duplicate - выражение уже было добавлено раньше или встречается в пачке второй раз.
+type BatchItem struct {
+	Position     int
+	ExpressionId string
+	Duplicate    bool
+	ErrorCode    string
+	Error        string
+	Status       string
+}
+
+// Event Структура события об изменении выражения или демона.
+// UserId - владелец выражения, у событий демонов пустой.
+type Event struct {
+	Id           int64
+	Type         string
+	UserId       string
+	ExpressionId string
+	OperationId  string
+	DaemonId     string
+	Status       string
+	Result       float32
+	ErrorCode    string
+	Error        string
+	CreatedAt    time.Time
+}
+
+// Webhook Структура callback'а выражения: куда отправить результат и как идет доставка.
+// State - pending (ждет завершения выражения или следующей попытки), delivered или failed.
+// Secret - свой ключ подписи у каждого callback'а, у добавленных до появления ключей пустой.
+type Webhook struct {
+	ExpressionId  string
+	URL           string
+	Secret        string
+	State         string
+	Attempts      int
+	NextAttemptAt time.Time
+	DeliveredAt   time.Time
+}
+
+// WebhookAttempt Структура одной попытки доставки callback'а
+type WebhookAttempt struct {
+	ExpressionId string
+	Attempt      int
+	StatusCode   int
+	Error        string
+	Duration     time.Duration
+	CreatedAt    time.Time
+}
+
+// Operation Структура одной бинарной операции выражения
+type Operation struct {
+	Id           string
+	ExpressionId string
+	ParentId     string
+	Side         string
+	Operation    string
+	Left         float64
+	Right        float64
+	LeftReady    bool
+	RightReady   bool
+	Status       string
+	Result       float64
+	DaemonId     string
+}
+
+// Ready Оба операнда операции известны
+func (o Operation) Ready() bool {
+	return o.LeftReady && o.RightReady
+}
+
+// CredentialsJSON жсончик с логином и паролем для регистрации и входа
+type CredentialsJSON struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// TokenJSON жсончик с выданным access токеном
+type TokenJSON struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// User Структура пользователя
+type User struct {
+	Id           string    `json:"id"`
+	Login        string    `json:"login"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	Disabled     bool      `json:"disabled"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DaemonCredentialsJSON жсончик с учетными данными нового демона
+type DaemonCredentialsJSON struct {
+	Id  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// Daemon Структура демона
+type Daemon struct {
+	Id           string    `json:"id"`
+	Status       string    `json:"status"`
+	LastResponse time.Time `json:"last_response"`
+}
+
+// ApiKeyRequestJSON жсончик для создания API ключа
+type ApiKeyRequestJSON struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// ApiKeyCreatedJSON жсончик с новым API ключом, сам ключ показывается только один раз
+type ApiKeyCreatedJSON struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+// ApiKey Структура API ключа
+type ApiKey struct {
+	Id         string     `json:"id"`
+	UserId     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// QuotaJSON жсончик с использованием дневной квоты операций
+type QuotaJSON struct {
+	Day       string    `json:"day"`
+	Used      int       `json:"operations_used"`
+	Limit     int       `json:"operations_limit"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// ResponseJSON жсончик-конверт для всех ответов /api/v1: либо data, либо error
+type ResponseJSON struct {
+	Data  any        `json:"data,omitempty"`
+	Page  *PageJSON  `json:"page,omitempty"`
+	Error *ErrorJSON `json:"error,omitempty"`
+}
+
+// PageJSON жсончик с курсором следующей страницы списка, пустой курсор - страница последняя
+type PageJSON struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	Limit      int    `json:"limit"`
+}
+
+// ErrorJSON жсончик ошибки с машинно-читаемым кодом
+type ErrorJSON struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// ExpressionJSON жсончик выражения в /api/v1
+type ExpressionJSON struct {
+	Id         string     `json:"id"`
+	Expression string     `json:"expression"`
+	Status     string     `json:"status"`
+	OwnerId    string     `json:"owner_id"`
+	Result     *float32   `json:"result,omitempty"`
+	Error      *ErrorJSON `json:"error,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	// CallbackSecret Ключ подписи callback'а, отдается один раз при добавлении
+	CallbackSecret string `json:"callback_secret,omitempty"`
+}
+
+// RegisteredJSON жсончик с зарегистрированным пользователем
+type RegisteredJSON struct {
+	Id    string `json:"id"`
+	Login string `json:"login"`
+}
+
+// BatchItemJSON жсончик одного выражения пачки
+type BatchItemJSON struct {
+	Index     int        `json:"index"`
+	Id        string     `json:"id,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	Duplicate bool       `json:"duplicate,omitempty"`
+	Error     *ErrorJSON `json:"error,omitempty"`
+	// CallbackSecret Ключ подписи callback'а, только в ответе на создание пачки у добавленных ею выражений
+	CallbackSecret string `json:"callback_secret,omitempty"`
+}
+
+// BatchJSON жсончик пачки с общим прогрессом: сколько выражений в каком статусе
+type BatchJSON struct {
+	Id        string          `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Total     int             `json:"total"`
+	Rejected  int             `json:"rejected"`
+	Counts    map[string]int  `json:"counts"`
+	Finished  bool            `json:"finished"`
+	Items     []BatchItemJSON `json:"items,omitempty"`
+}
+
+// EventJSON жсончик события в потоке /api/v1/events
+type EventJSON struct {
+	Id           int64      `json:"id"`
+	Type         string     `json:"type"`
+	ExpressionId string     `json:"expression_id,omitempty"`
+	OperationId  string     `json:"operation_id,omitempty"`
+	DaemonId     string     `json:"daemon_id,omitempty"`
+	Status       string     `json:"status"`
+	Result       *float32   `json:"result,omitempty"`
+	Error        *ErrorJSON `json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// WsRequestJSON жсончик сообщения клиента по WebSocket: submit, subscribe или unsubscribe
+type WsRequestJSON struct {
+	Type       string   `json:"type"`
+	RequestId  string   `json:"request_id,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+	UseCache   bool     `json:"use_cache,omitempty"`
+	Ids        []string `json:"ids,omitempty"`
+}
+
+// WsMessageJSON жсончик сообщения сервера по WebSocket: ответ на запрос клиента или выражение с результатом
+type WsMessageJSON struct {
+	Type       string          `json:"type"`
+	RequestId  string          `json:"request_id,omitempty"`
+	Created    bool            `json:"created,omitempty"`
+	Ids        []string        `json:"ids,omitempty"`
+	Expression *ExpressionJSON `json:"expression,omitempty"`
+	Error      *ErrorJSON      `json:"error,omitempty"`
+}
+
+// WebhookPayloadJSON жсончик, который отправляется на callback URL
+type WebhookPayloadJSON struct {
+	Event      string         `json:"event"`
+	Expression ExpressionJSON `json:"expression"`
+}
+
+// WebhookAttemptJSON жсончик попытки доставки callback'а
+type WebhookAttemptJSON struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookJSON жсончик callback'а выражения с попытками доставки
+type WebhookJSON struct {
+	URL           string               `json:"url"`
+	State         string               `json:"state"`
+	Attempts      int                  `json:"attempts"`
+	NextAttemptAt *time.Time           `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time           `json:"delivered_at,omitempty"`
+	Deliveries    []WebhookAttemptJSON `json:"deliveries"`
 }
@@ -0,0 +1,351 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/j0pl0p/final-task-GO-YL/api"
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/events"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Заголовки запроса с результатом
+const (
+	HeaderId        = "X-Webhook-Id"
+	HeaderAttempt   = "X-Webhook-Attempt"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+	// HeaderSecret Ключ подписи в ответе старого /add-expression, где тело - просто текст
+	HeaderSecret = "X-Webhook-Secret"
+)
+
+// ErrForbiddenAddress Callback ведет во внутреннюю сеть: на сам сервер, в частные или link-local сети
+var ErrForbiddenAddress = errors.New("callback address is not allowed")
+
+// forbiddenNets Сети, которые не покрываются методами net.IP: 0.0.0.0/8, CGNAT и сети для тестов производительности
+var forbiddenNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),
+	mustCIDR("100.64.0.0/10"),
+	mustCIDR("198.18.0.0/15"),
+}
+
+// Sender Доставка результатов выражений на их callback URL: POST с JSON, подписанным HMAC-SHA256
+// ключом этого callback'а. Неудачные попытки повторяются с экспоненциальной задержкой, каждая попытка записывается в базу.
+type Sender struct {
+	storage *data.Storage
+	// legacySecret Общий ключ, которым подписываются callback'и, добавленные до появления своих ключей
+	legacySecret []byte
+	client       *http.Client
+	mu           sync.Mutex
+	maxAttempts  int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	wake         chan struct{}
+	inflight     map[string]bool
+	slots        chan struct{}
+	// allowPrivate Разрешить адреса внутренних сетей, только для локальной разработки
+	allowPrivate bool
+}
+
+// New Создание отправителя. legacySecret подписывает только callback'и без своего ключа, может быть пустым.
+// Адрес проверяется при каждом соединении уже после DNS, так что имя, которое потом стало указывать
+// во внутреннюю сеть, тоже не пройдет. Редиректы не выполняются: 3xx считается неудачной попыткой.
+func New(storage *data.Storage, legacySecret []byte) *Sender {
+	s := &Sender{
+		storage:      storage,
+		legacySecret: legacySecret,
+		maxAttempts:  8,
+		baseDelay:    time.Second,
+		maxDelay:     10 * time.Minute,
+		wake:         make(chan struct{}, 1),
+		inflight:     map[string]bool{},
+		slots:        make(chan struct{}, 8),
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: s.control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Через прокси соединение шло бы к прокси, и проверка адреса получателя не сработала бы
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	s.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return s
+}
+
+// AllowPrivateNetworks Разрешение callback'ов во внутренние сети (localhost, 10/8...), только для локальной разработки
+func (s *Sender) AllowPrivateNetworks(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowPrivate = allow
+}
+
+// ValidateURL Проверка callback URL при добавлении: абсолютный http(s) адрес не длиннее 2048 символов,
+// не localhost и не IP из запрещенных сетей. Имена окончательно проверяются при каждой отправке, после DNS.
+func (s *Sender) ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || len(raw) > 2048 {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	s.mu.Lock()
+	allow := s.allowPrivate
+	s.mu.Unlock()
+	if allow {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && Forbidden(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// control Проверка адреса, к которому уже подключается dialer (после DNS)
+func (s *Sender) control(network, address string, _ syscall.RawConn) error {
+	s.mu.Lock()
+	allow := s.allowPrivate
+	s.mu.Unlock()
+	if allow {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || Forbidden(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// Forbidden Адрес, на который callback'и не отправляются: loopback, частные и link-local сети
+// (в том числе 169.254.169.254 облачных метаданных), multicast и неуказанный адрес
+func Forbidden(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// SetRetries Настройка повторов: число попыток и задержка перед второй попыткой, дальше она удваивается до maxDelay
+func (s *Sender) SetRetries(maxAttempts int, baseDelay, maxDelay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxAttempts = maxAttempts
+	s.baseDelay = baseDelay
+	s.maxDelay = maxDelay
+}
+
+// Wake Внеочередная проверка callback'ов, не дожидаясь таймера
+func (s *Sender) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Follow Проверка callback'ов сразу, как только в потоке событий выражение завершилось
+func (s *Sender) Follow(stream *events.Stream) {
+	for {
+		sub := stream.SubscribeAll()
+		for e := range sub.C {
+			switch e.Status {
+			case "done", "failed", "cancelled":
+				s.Wake()
+			}
+		}
+		// Подписку отключили из-за отставания: пропущенное подберет Run по таймеру
+	}
+}
+
+// Run Цикл доставки: раз в poll и по Wake отправляет callback'и, время которых пришло
+func (s *Sender) Run(poll time.Duration) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.deliverDue()
+	}
+}
+
+func (s *Sender) deliverDue() {
+	due, err := s.storage.GetDueWebhooks(time.Now(), 100)
+	if err != nil {
+		log.Println("cant get due webhooks", err.Error())
+		return
+	}
+	for _, w := range due {
+		if !s.claim(w.ExpressionId) {
+			continue
+		}
+		// Не больше cap(slots) запросов одновременно, медленные получатели не плодят горутины
+		s.slots <- struct{}{}
+		go func(w structures.Webhook) {
+			defer func() {
+				<-s.slots
+				s.release(w.ExpressionId)
+			}()
+			s.deliver(w)
+		}(w)
+	}
+}
+
+// claim Отметка, что callback уже отправляется, чтобы следующий проход не отправил его второй раз
+func (s *Sender) claim(expressionId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight[expressionId] {
+		return false
+	}
+	s.inflight[expressionId] = true
+	return true
+}
+
+func (s *Sender) release(expressionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, expressionId)
+}
+
+// deliver Одна попытка доставки и запись ее результата
+func (s *Sender) deliver(w structures.Webhook) {
+	attempt := structures.WebhookAttempt{ExpressionId: w.ExpressionId, Attempt: w.Attempts + 1, CreatedAt: time.Now()}
+	status, err := s.post(w, attempt.Attempt)
+	attempt.Duration = time.Since(attempt.CreatedAt)
+	attempt.StatusCode = status
+	state, next := "delivered", time.Time{}
+	if err != nil {
+		attempt.Error = err.Error()
+		if len(attempt.Error) > 256 {
+			attempt.Error = attempt.Error[:256]
+		}
+		s.mu.Lock()
+		maxAttempts := s.maxAttempts
+		s.mu.Unlock()
+		state, next = "pending", time.Now().Add(s.backoff(attempt.Attempt))
+		if attempt.Attempt >= maxAttempts {
+			state, next = "failed", time.Time{}
+		}
+		log.Println("webhook delivery failed:", w.ExpressionId, "attempt", attempt.Attempt, err.Error())
+	} else {
+		log.Println("webhook delivered:", w.ExpressionId, "attempt", attempt.Attempt)
+	}
+	if err := s.storage.SaveWebhookAttempt(attempt, state, next); err != nil {
+		log.Println("cant save webhook attempt", w.ExpressionId, err.Error())
+	}
+}
+
+// post Отправка результата выражения, ошибка - если получатель не ответил 2xx
+func (s *Sender) post(w structures.Webhook, attempt int) (int, error) {
+	exp, ok := s.storage.GetExpressionById(w.ExpressionId)
+	if !ok {
+		return 0, fmt.Errorf("expression %s not found", w.ExpressionId)
+	}
+	body, err := json.Marshal(structures.WebhookPayloadJSON{
+		Event:      "expression." + exp.Status,
+		Expression: api.Expression(exp),
+	})
+	if err != nil {
+		return 0, err
+	}
+	secret := []byte(w.Secret)
+	if w.Secret == "" {
+		secret = s.legacySecret
+	}
+	if len(secret) == 0 {
+		return 0, errors.New("callback has no signing secret")
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderId, w.ExpressionId)
+	req.Header.Set(HeaderAttempt, strconv.Itoa(attempt))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(secret, timestamp, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff Задержка после attempt неудачных попыток: baseDelay * 2^(attempt-1), не больше maxDelay
+func (s *Sender) backoff(attempt int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delay := s.baseDelay
+	for i := 1; i < attempt && delay < s.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.maxDelay {
+		delay = s.maxDelay
+	}
+	return delay
+}
+
+// NewSecret Новый ключ подписи callback'а: 32 случайных байта в hex. Отдается клиенту один раз при добавлении.
+func NewSecret() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Sign Подпись тела запроса: hex HMAC-SHA256 от "timestamp.body". Получатель считает ее тем же секретом
+// и сравнивает с заголовком X-Webhook-Signature, а по X-Webhook-Timestamp отбрасывает старые запросы.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
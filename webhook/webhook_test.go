@@ -0,0 +1,241 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/j0pl0p/final-task-GO-YL/data"
+	"github.com/j0pl0p/final-task-GO-YL/structures"
+)
+
+func TestForbidden(t *testing.T) {
+	tests := []struct {
+		ip        string
+		forbidden bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"ff02::1", true},
+		{"172.32.0.1", false},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"2001:4860:4860::8888", false},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := Forbidden(net.ParseIP(tt.ip)); got != tt.forbidden {
+				t.Errorf("Forbidden(%s) = %v, want %v", tt.ip, got, tt.forbidden)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url       string
+		ok        bool
+		forbidden bool
+	}{
+		{"https://example.com/hook", true, false},
+		{"http://93.184.216.34:8080/hook", true, false},
+		{"http://[2001:4860:4860::8888]/hook", true, false},
+		{"http://localhost/hook", false, true},
+		{"http://LOCALHOST./hook", false, true},
+		{"http://api.localhost/hook", false, true},
+		{"http://127.0.0.1:8080/hook", false, true},
+		{"http://10.0.0.1/hook", false, true},
+		{"http://192.168.0.10/hook", false, true},
+		{"http://169.254.169.254/latest/meta-data", false, true},
+		{"http://[::1]/hook", false, true},
+		{"http://[fd00::1]/hook", false, true},
+		{"http://[fe80::1]/hook", false, true},
+		{"http://[::ffff:127.0.0.1]/hook", false, true},
+		{"http://[::ffff:a00:1]/hook", false, true},
+		{"ftp://example.com/hook", false, false},
+		{"/hook", false, false},
+		{"http:///hook", false, false},
+		{"https://example.com/" + strings.Repeat("a", 2048), false, false},
+	}
+	s := New(nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := s.ValidateURL(tt.url)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ValidateURL error = %v, want ok %v", err, tt.ok)
+			}
+			if errors.Is(err, ErrForbiddenAddress) != tt.forbidden {
+				t.Errorf("ValidateURL error = %v, want forbidden %v", err, tt.forbidden)
+			}
+		})
+	}
+
+	s.AllowPrivateNetworks(true)
+	if err := s.ValidateURL("http://localhost:8080/hook"); err != nil {
+		t.Errorf("ValidateURL with private networks allowed error = %v", err)
+	}
+	if err := s.ValidateURL("ftp://localhost/hook"); err == nil {
+		t.Error("ValidateURL with private networks allowed accepted ftp")
+	}
+}
+
+// testSender Отправитель с базой, в которой есть готовое выражение e1
+func testSender(t *testing.T, legacySecret string) *Sender {
+	t.Helper()
+	storage, err := data.NewStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Db.Close() })
+	exp := data.NewExpression{Id: "e1", Exp: "1+2", UserId: "u1", Cached: true, Result: 3}
+	if _, err := storage.AddExpression(exp, data.Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	return New(storage, []byte(legacySecret))
+}
+
+func TestPostToPrivateNetwork(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer srv.Close()
+	s := testSender(t, "")
+	// Имя проверяется только после DNS, при соединении
+	url := "http://localhost:" + strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port)
+	for _, u := range []string{srv.URL, url} {
+		_, err := s.post(structures.Webhook{ExpressionId: "e1", URL: u, Secret: "key"}, 1)
+		if !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("post to %s error = %v, want %v", u, err, ErrForbiddenAddress)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("forbidden server got %d requests", hits)
+	}
+
+	s.AllowPrivateNetworks(true)
+	if _, err := s.post(structures.Webhook{ExpressionId: "e1", URL: srv.URL, Secret: "key"}, 1); err != nil {
+		t.Fatalf("post with private networks allowed error = %v", err)
+	}
+	if hits != 1 {
+		t.Errorf("server got %d requests, want 1", hits)
+	}
+}
+
+func TestPostDoesNotFollowRedirects(t *testing.T) {
+	followed := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	s := testSender(t, "")
+	s.AllowPrivateNetworks(true)
+	status, err := s.post(structures.Webhook{ExpressionId: "e1", URL: srv.URL + "/hook", Secret: "key"}, 1)
+	if err == nil || status != http.StatusTemporaryRedirect {
+		t.Errorf("post = %d, %v, want a failed attempt with 307", status, err)
+	}
+	if followed {
+		t.Error("redirect is followed")
+	}
+}
+
+func TestPostSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		legacy string
+		key    string // "" - отправка без подписи невозможна
+	}{
+		{"own secret", "key", "legacy", "key"},
+		{"legacy secret", "", "legacy", "legacy"},
+		{"no secret", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req = r
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer srv.Close()
+			s := testSender(t, tt.legacy)
+			s.AllowPrivateNetworks(true)
+			_, err := s.post(structures.Webhook{ExpressionId: "e1", URL: srv.URL, Secret: tt.secret}, 2)
+			if tt.key == "" {
+				if err == nil || req != nil {
+					t.Fatalf("post without a secret error = %v, request sent %v", err, req != nil)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Header.Get(HeaderId) != "e1" || req.Header.Get(HeaderAttempt) != "2" {
+				t.Errorf("headers = %v", req.Header)
+			}
+			timestamp := req.Header.Get(HeaderTimestamp)
+			sent, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+				t.Errorf("timestamp = %q", timestamp)
+			}
+			want := "sha256=" + Sign([]byte(tt.key), timestamp, body)
+			if got := req.Header.Get(HeaderSignature); !hmac.Equal([]byte(got), []byte(want)) {
+				t.Errorf("signature = %s, want %s", got, want)
+			}
+			// Подпись покрывает и время, и тело
+			if Sign([]byte(tt.key), timestamp, append(body, ' ')) == want[len("sha256="):] ||
+				Sign([]byte(tt.key), strconv.FormatInt(sent+1, 10), body) == want[len("sha256="):] {
+				t.Error("signature does not depend on the body or the timestamp")
+			}
+			var payload structures.WebhookPayloadJSON
+			if err := json.Unmarshal(body, &payload); err != nil || payload.Event != "expression.done" {
+				t.Errorf("payload = %s, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := New(nil, nil)
+	s.SetRetries(8, time.Second, 10*time.Second)
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := s.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}